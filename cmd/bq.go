@@ -2,92 +2,415 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"io"
 	"log"
+	"os"
+	"strings"
+	"sync"
 	"time"
 
 	"cloud.google.com/go/bigquery"
 	"github.com/karman-dev-team/xero-transaction-bq-uploader/models"
 )
 
-func uploadInvoices(transactions []models.AccountTransaction, company string, accountLookup map[string]models.AccountLookup) error {
-	bqInvoices, err := convertToBQInvoice(transactions, company, accountLookup)
+var (
+	tableLocksMu sync.Mutex
+	tableLocks   = make(map[models.BQDestination]*sync.Mutex)
+)
+
+// lockTable waits until no other tenant is running DML on destination and
+// returns the function that releases it. BigQuery aborts DML statements that
+// update the same table at the same time, and tenants can share a table.
+func lockTable(destination models.BQDestination) func() {
+	tableLocksMu.Lock()
+	lock, ok := tableLocks[destination]
+	if !ok {
+		lock = &sync.Mutex{}
+		tableLocks[destination] = lock
+	}
+	tableLocksMu.Unlock()
+	lock.Lock()
+	return lock.Unlock
+}
+
+// rowWriter receives the converted rows of one company in batches.
+// Close must always be called. Rows may not be visible in the destination
+// until it returns, and closing with a cancelled context discards them.
+type rowWriter[T any] interface {
+	Write(ctx context.Context, rows []T) error
+	Close(ctx context.Context) error
+}
+
+// newBQWriter returns a writer for the rows of one company. The row type T
+// must have company and id columns. By default rows are merged on
+// (company, id) so re-running an import is safe;
+// setting BQ_WRITE_MODE=append restores the old streaming inserts. fullSync
+// must only be set when every row Xero has for the company will be written,
+// as target rows missing from them are then flagged as deleted; T must then
+// also have a deleted column.
+func newBQWriter[T any](ctx context.Context, report progressFunc, company string, destination models.BQDestination, fullSync bool) (rowWriter[T], error) {
+	client, err := bigquery.NewClient(ctx, destination.ProjectID)
 	if err != nil {
-		return err
+		log.Printf("Failed to create BigQuery client: %v", err)
+		return nil, err
+	}
+	dataset := client.Dataset(destination.DatasetID)
+	table := dataset.Table(destination.TableID)
+	if os.Getenv("BQ_WRITE_MODE") == "append" {
+		return &appendWriter[T]{client: client, report: report, table: destination.TableID, uploader: table.Uploader()}, nil
+	}
+	var row T
+	schema, err := bigquery.InferSchema(row)
+	if err != nil {
+		client.Close()
+		return nil, err
 	}
-	batchSize := 1000
-	batches := splitIntoBatches(bqInvoices, batchSize)
-	err = uploadToBQ(batches)
+	return &mergeWriter[T]{
+		client:   client,
+		report:   report,
+		company:  company,
+		table:    table,
+		staging:  dataset.Table(fmt.Sprintf("%s_staging_%s", destination.TableID, strings.ToLower(company))),
+		schema:   schema,
+		fullSync: fullSync,
+	}, nil
+}
+
+// mergeWriter streams rows into a staging table through a single load job
+// and merges the staging table into the target table on Close. The load job
+// reads from a pipe, so Write blocks while BigQuery is behind instead of
+// holding the rows in memory.
+type mergeWriter[T any] struct {
+	client   *bigquery.Client
+	report   progressFunc
+	company  string
+	table    *bigquery.Table
+	staging  *bigquery.Table
+	schema   bigquery.Schema
+	fullSync bool
 
+	pipe    *io.PipeWriter
+	encoder *json.Encoder
+	loaded  chan error
+	rows    int
+}
+
+func (w *mergeWriter[T]) Write(ctx context.Context, rows []T) error {
+	if w.pipe == nil {
+		w.startLoad(ctx)
+	}
+	for _, row := range rows {
+		saver := bigquery.StructSaver{Struct: row, Schema: w.schema}
+		values, _, err := saver.Save()
+		if err != nil {
+			return err
+		}
+		err = w.encoder.Encode(values)
+		if err != nil {
+			return err
+		}
+	}
+	w.rows += len(rows)
+	w.report.send(models.JobEvent{Type: "staged", Endpoint: w.table.TableID, Rows: w.rows})
+	return nil
+}
+
+// startLoad starts the load job that replaces the contents of the staging
+// table with everything written to the pipe.
+func (w *mergeWriter[T]) startLoad(ctx context.Context) {
+	reader, writer := io.Pipe()
+	w.pipe = writer
+	w.encoder = json.NewEncoder(writer)
+	w.loaded = make(chan error, 1)
+
+	source := bigquery.NewReaderSource(reader)
+	source.SourceFormat = bigquery.JSON
+	source.Schema = w.schema
+	loader := w.staging.LoaderFrom(source)
+	loader.CreateDisposition = bigquery.CreateIfNeeded
+	loader.WriteDisposition = bigquery.WriteTruncate
+	go func() {
+		err := func() error {
+			job, err := loader.Run(ctx)
+			if err != nil {
+				return err
+			}
+			status, err := job.Wait(ctx)
+			if err != nil {
+				return err
+			}
+			return status.Err()
+		}()
+		if err != nil {
+			// Unblock Write if the load failed before reading everything.
+			reader.CloseWithError(err)
+		}
+		w.loaded <- err
+	}()
+}
+
+func (w *mergeWriter[T]) Close(ctx context.Context) error {
+	defer w.client.Close()
+	if w.pipe == nil {
+		if !w.fullSync || ctx.Err() != nil {
+			return nil
+		}
+		// An empty full sync still has to flag every row as deleted.
+		w.startLoad(ctx)
+	}
+	if ctx.Err() != nil {
+		w.pipe.CloseWithError(ctx.Err())
+	} else {
+		w.pipe.Close()
+	}
+	defer func() {
+		err := w.staging.Delete(context.Background())
+		if err != nil {
+			log.Printf("Failed to delete staging table %s: %v", w.staging.TableID, err)
+		}
+	}()
+	err := <-w.loaded
 	if err != nil {
+		return fmt.Errorf("loading staging table %s: %w", w.staging.TableID, err)
+	}
+
+	defer lockTable(models.BQDestination{ProjectID: w.table.ProjectID, DatasetID: w.table.DatasetID, TableID: w.table.TableID})()
+	query := w.client.Query(buildMergeQuery(w.table, w.staging, w.schema, w.fullSync))
+	query.Parameters = []bigquery.QueryParameter{{Name: "company", Value: w.company}}
+	job, err := query.Run(ctx)
+	if err != nil {
+		return err
+	}
+	status, err := job.Wait(ctx)
+	if err != nil {
+		return err
+	}
+	if err := status.Err(); err != nil {
 		return err
 	}
+	if stats, ok := status.Statistics.Details.(*bigquery.QueryStatistics); ok {
+		fmt.Printf("Merged %d rows for %s\n", stats.NumDMLAffectedRows, w.company)
+		w.report.send(models.JobEvent{Type: "merged", Endpoint: w.table.TableID, Rows: int(stats.NumDMLAffectedRows)})
+	}
 	return nil
 }
 
-func uploadToBQ(batches [][]models.BQTransaction) error {
-	maxRetries := 10
-	retryInterval := 5 * time.Second
-	ctx := context.Background()
-	client, err := bigquery.NewClient(ctx, "reporting-393509")
+// fillJournalContacts sets contact_id on the company's transaction rows that
+// came from journals, which Xero does not give a contact, by looking up the
+// document each journal was raised for in the document tables, or the bank
+// transaction in the bank transaction rows of destination. It only touches
+// rows that have no contact yet, and must run after the document tables have
+// been merged. Only the rows of sourceIDs are updated, or every row of the
+// company when sourceIDs is nil.
+func fillJournalContacts(ctx context.Context, company string, destination models.BQDestination, documentTables []models.BQDestination, sourceIDs []string) error {
+	if sourceIDs != nil && len(sourceIDs) == 0 {
+		return nil
+	}
+	params := []bigquery.QueryParameter{}
+	if sourceIDs != nil {
+		params = append(params, bigquery.QueryParameter{Name: "source_ids", Value: sourceIDs})
+	}
+	_, err := runStatement(ctx, destination, buildContactsQuery(destination, documentTables, sourceIDs != nil), company, params...)
+	return err
+}
+
+// runStatement runs a DML statement on destination with a @company parameter,
+// and any others given, and returns the number of rows it changed.
+func runStatement(ctx context.Context, destination models.BQDestination, sql string, company string, params ...bigquery.QueryParameter) (int64, error) {
+	client, err := bigquery.NewClient(ctx, destination.ProjectID)
 	if err != nil {
-		log.Printf("Failed to create BigQuery client: %v", err)
-		return err
+		return 0, err
 	}
 	defer client.Close()
+	defer lockTable(destination)()
+	query := client.Query(sql)
+	query.Parameters = append([]bigquery.QueryParameter{{Name: "company", Value: company}}, params...)
+	job, err := query.Run(ctx)
+	if err != nil {
+		return 0, err
+	}
+	status, err := job.Wait(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if err := status.Err(); err != nil {
+		return 0, err
+	}
+	if stats, ok := status.Statistics.Details.(*bigquery.QueryStatistics); ok {
+		return stats.NumDMLAffectedRows, nil
+	}
+	return 0, nil
+}
 
-	dataset := client.Dataset("internal_reporting")
-	table := dataset.Table("xero_transactions")
-	uploader := table.Uploader()
-
-	for i, batch := range batches {
-		var retryCount int
-		for retryCount < maxRetries {
-			err := uploader.Put(ctx, batch)
-			if err == nil {
-				fmt.Printf("Uploaded Batch %d...\n", i+1)
-				break
-			}
-			retryCount++
-			log.Printf("Failed to insert data for Batch %d: %v. Retrying", i+1, err)
-			if retryCount < maxRetries {
-				time.Sleep(retryInterval)
-			}
+func buildContactsQuery(destination models.BQDestination, documentTables []models.BQDestination, bySource bool) string {
+	sources := []string{
+		fmt.Sprintf("SELECT source_id AS id, contact_id FROM `%s.%s.%s` WHERE company = @company AND origin = '%s' AND contact_id != ''", destination.ProjectID, destination.DatasetID, destination.TableID, bankTransactionsEndpoint),
+	}
+	for _, table := range documentTables {
+		sources = append(sources, fmt.Sprintf("SELECT id, contact_id FROM `%s.%s.%s` WHERE company = @company AND contact_id != ''", table.ProjectID, table.DatasetID, table.TableID))
+	}
+	query := fmt.Sprintf("UPDATE `%s.%s.%s` T SET contact_id = S.contact_id\n", destination.ProjectID, destination.DatasetID, destination.TableID)
+	query += fmt.Sprintf("FROM (SELECT id, ANY_VALUE(contact_id) AS contact_id FROM (%s) GROUP BY id) S\n", strings.Join(sources, " UNION ALL "))
+	query += "WHERE T.company = @company AND T.source_id = S.id AND IFNULL(T.contact_id, '') = ''\n"
+	if bySource {
+		query += "AND T.source_id IN UNNEST(@source_ids)\n"
+	}
+	return query
+}
+
+func hasColumn(schema bigquery.Schema, name string) bool {
+	for _, field := range schema {
+		if field.Name == name {
+			return true
 		}
-		if retryCount == maxRetries {
-			fmt.Printf("Exceeded maximum retries for Batch %d, giving up.\n", i+1)
+	}
+	return false
+}
+
+func buildMergeQuery(table *bigquery.Table, staging *bigquery.Table, schema bigquery.Schema, fullSync bool) string {
+	columns := []string{}
+	updates := []string{}
+	values := []string{}
+	for _, field := range schema {
+		columns = append(columns, field.Name)
+		values = append(values, "S."+field.Name)
+		if field.Name != "company" && field.Name != "id" {
+			updates = append(updates, fmt.Sprintf("%s = S.%s", field.Name, field.Name))
 		}
 	}
-	return nil
+	query := fmt.Sprintf("MERGE `%s.%s.%s` T\n", table.ProjectID, table.DatasetID, table.TableID)
+	query += fmt.Sprintf("USING (SELECT * FROM `%s.%s.%s` WHERE TRUE QUALIFY ROW_NUMBER() OVER (PARTITION BY company, id) = 1) S\n", staging.ProjectID, staging.DatasetID, staging.TableID)
+	query += "ON T.company = S.company AND T.id = S.id\n"
+	query += fmt.Sprintf("WHEN MATCHED THEN UPDATE SET %s\n", strings.Join(updates, ", "))
+	query += fmt.Sprintf("WHEN NOT MATCHED THEN INSERT (%s) VALUES (%s)\n", strings.Join(columns, ", "), strings.Join(values, ", "))
+	if fullSync {
+		query += "WHEN NOT MATCHED BY SOURCE AND T.company = @company AND NOT IFNULL(T.deleted, FALSE) THEN UPDATE SET deleted = TRUE\n"
+	} else if hasColumn(schema, "origin") {
+		// A bank transaction is sent with all of its line items, so any other
+		// row for it is a line that has been removed, or a row written before
+		// rows were split by line item and keyed by the transaction ID.
+		bankSources := fmt.Sprintf("SELECT source_id FROM `%s.%s.%s` WHERE origin = '%s'", staging.ProjectID, staging.DatasetID, staging.TableID, bankTransactionsEndpoint)
+		query += fmt.Sprintf("WHEN NOT MATCHED BY SOURCE AND T.company = @company AND NOT IFNULL(T.deleted, FALSE) AND ((T.origin = '%s' AND T.source_id IN (%s)) OR (T.origin IS NULL AND T.id IN (%s))) THEN UPDATE SET deleted = TRUE\n", bankTransactionsEndpoint, bankSources, bankSources)
+	}
+	return query
 }
 
-func splitIntoBatches(slice []models.BQTransaction, batchSize int) [][]models.BQTransaction {
-	var batches [][]models.BQTransaction
+// appendWriter streams each batch straight into the target table.
+type appendWriter[T any] struct {
+	client   *bigquery.Client
+	report   progressFunc
+	table    string
+	uploader *bigquery.Uploader
+	batch    int
+}
 
-	for batchSize < len(slice) {
-		slice, batches = slice[batchSize:], append(batches, slice[0:batchSize:batchSize])
+func (w *appendWriter[T]) Write(ctx context.Context, rows []T) error {
+	maxRetries := 10
+	retryInterval := 5 * time.Second
+	w.batch++
+	var retryCount int
+	var err error
+	for retryCount < maxRetries {
+		err = w.uploader.Put(ctx, rows)
+		if err == nil {
+			fmt.Printf("Uploaded Batch %d...\n", w.batch)
+			w.report.send(models.JobEvent{Type: "batch", Endpoint: w.table, Batch: w.batch, Rows: len(rows)})
+			break
+		}
+		retryCount++
+		log.Printf("Failed to insert data for Batch %d: %v. Retrying", w.batch, err)
+		if retryCount < maxRetries {
+			sleepErr := sleepContext(ctx, retryInterval)
+			if sleepErr != nil {
+				return sleepErr
+			}
+		}
+	}
+	if retryCount == maxRetries {
+		return fmt.Errorf("inserting batch %d into %s failed %d times: %w", w.batch, w.table, maxRetries, err)
 	}
-	batches = append(batches, slice)
+	return nil
+}
 
-	return batches
+func (w *appendWriter[T]) Close(ctx context.Context) error {
+	return w.client.Close()
 }
 
-func convertToBQInvoice(transactions []models.AccountTransaction, company string, accountLookup map[string]models.AccountLookup) ([]models.BQTransaction, error) {
+// convertToBQInvoice converts the transactions that have a mapped account.
+// Live transactions whose account code is not mapped are added to unmapped.
+// Transactions without a currency, such as journal lines, are in the base
+// currency of the organisation.
+func convertToBQInvoice(transactions []models.AccountTransaction, company string, mapping accountMapping, fx fxConverter, unmapped *unmappedAccounts, missing *missingRates) ([]models.BQTransaction, error) {
 	bqTransactions := []models.BQTransaction{}
 	for _, transaction := range transactions {
-		if val, ok := accountLookup[transaction.AccountCode]; ok {
+		val, ok := mapping.lookup(transaction.AccountCode, transaction.Date)
+		if !ok {
+			rule, hasRule := mapping.rule(transaction.AccountCode, transaction.Date)
+			if !transaction.Deleted && !(hasRule && rule.Action == ruleActionDelete) {
+				unmapped.add(transaction)
+			}
+		}
+		if ok {
+			currency := transaction.CurrencyCode
+			rate := transaction.CurrencyRate
+			if currency == "" {
+				currency = fx.baseCurrency
+			}
+			if strings.EqualFold(currency, fx.baseCurrency) {
+				rate = 1
+			}
+			reportingAmount := bigquery.NullFloat64{}
+			amount, missingPair := fx.toReporting(transaction.GrossAmount, currency, rate, transaction.Date)
+			if missingPair == "" {
+				reportingAmount = bigquery.NullFloat64{Float64: amount, Valid: true}
+			} else {
+				missing.add(missingPair, transaction)
+			}
 			bqTransaction := models.BQTransaction{
-				TransactionID: transaction.TransactionID,
-				Company:       company,
-				Date:          transaction.Date,
-				Amount:        transaction.Amount,
-				Reference:     transaction.Reference,
-				Description:   transaction.Description,
-				RevenueLine:   val.Name,
-				Group:         val.Group,
+				TransactionID:     transaction.TransactionID,
+				Company:           company,
+				Date:              transaction.Date,
+				Amount:            transaction.Amount,
+				Reference:         transaction.Reference,
+				Description:       transaction.Description,
+				RevenueLine:       val.Name,
+				Group:             val.Group,
+				AccountCode:       transaction.AccountCode,
+				Debit:             max(transaction.GrossAmount, 0),
+				Credit:            max(-transaction.GrossAmount, 0),
+				NetAmount:         transaction.NetAmount,
+				TaxAmount:         transaction.TaxAmount,
+				TaxType:           transaction.TaxType,
+				GrossAmount:       transaction.GrossAmount,
+				CurrencyCode:      currency,
+				OriginalAmount:    transaction.GrossAmount,
+				CurrencyRate:      rate,
+				ReportingCurrency: fx.reportingCurrency,
+				ReportingAmount:   reportingAmount,
+				ContactID:         transaction.ContactID,
+				SourceID:          transaction.SourceID,
+				SourceType:        transaction.SourceType,
+				Origin:            transaction.Origin,
+				Tracking:          convertTracking(transaction.Tracking),
+				Deleted:           transaction.Deleted,
 			}
 			bqTransactions = append(bqTransactions, bqTransaction)
 		}
 	}
 	return bqTransactions, nil
 }
+
+func convertTracking(tracking []models.TrackingItem) []models.BQTracking {
+	bqTracking := []models.BQTracking{}
+	for _, item := range tracking {
+		bqTracking = append(bqTracking, models.BQTracking{
+			CategoryID: item.TrackingCategoryID,
+			Category:   item.Name,
+			OptionID:   item.TrackingOptionID,
+			Option:     item.Option,
+		})
+	}
+	return bqTracking
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/bigquery"
+)
+
+func TestBuildMergeQuery(t *testing.T) {
+	table := &bigquery.Table{ProjectID: "p", DatasetID: "d", TableID: "transactions"}
+	staging := &bigquery.Table{ProjectID: "p", DatasetID: "d", TableID: "transactions_staging_kd"}
+	field := func(name string) *bigquery.FieldSchema {
+		return &bigquery.FieldSchema{Name: name, Type: bigquery.StringFieldType}
+	}
+	withOrigin := bigquery.Schema{field("company"), field("id"), field("amount"), field("origin"), field("source_id")}
+	withoutOrigin := bigquery.Schema{field("company"), field("id"), field("name")}
+	tests := []struct {
+		name     string
+		schema   bigquery.Schema
+		fullSync bool
+		want     []string
+		notWant  []string
+	}{
+		{
+			name:   "incremental",
+			schema: withOrigin,
+			want: []string{
+				"MERGE `p.d.transactions` T\n",
+				"USING (SELECT * FROM `p.d.transactions_staging_kd` WHERE TRUE QUALIFY ROW_NUMBER() OVER (PARTITION BY company, id) = 1) S\n",
+				"ON T.company = S.company AND T.id = S.id\n",
+				"WHEN MATCHED THEN UPDATE SET amount = S.amount, origin = S.origin, source_id = S.source_id\n",
+				"WHEN NOT MATCHED THEN INSERT (company, id, amount, origin, source_id) VALUES (S.company, S.id, S.amount, S.origin, S.source_id)\n",
+				"WHEN NOT MATCHED BY SOURCE AND T.company = @company AND NOT IFNULL(T.deleted, FALSE) AND ((T.origin = 'BankTransactions' AND T.source_id IN (SELECT source_id FROM `p.d.transactions_staging_kd` WHERE origin = 'BankTransactions')) OR (T.origin IS NULL AND T.id IN (SELECT source_id FROM `p.d.transactions_staging_kd` WHERE origin = 'BankTransactions'))) THEN UPDATE SET deleted = TRUE\n",
+			},
+		},
+		{
+			name:     "full sync",
+			schema:   withOrigin,
+			fullSync: true,
+			want:     []string{"WHEN NOT MATCHED BY SOURCE AND T.company = @company AND NOT IFNULL(T.deleted, FALSE) THEN UPDATE SET deleted = TRUE\n"},
+			notWant:  []string{"T.source_id IN"},
+		},
+		{
+			name:    "documents",
+			schema:  withoutOrigin,
+			want:    []string{"WHEN MATCHED THEN UPDATE SET name = S.name\n"},
+			notWant: []string{"NOT MATCHED BY SOURCE"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			query := buildMergeQuery(table, staging, test.schema, test.fullSync)
+			for _, want := range test.want {
+				if !strings.Contains(query, want) {
+					t.Errorf("query does not contain %q:\n%s", want, query)
+				}
+			}
+			for _, notWant := range test.notWant {
+				if strings.Contains(query, notWant) {
+					t.Errorf("query contains %q:\n%s", notWant, query)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/karman-dev-team/xero-transaction-bq-uploader/models"
+	"golang.org/x/oauth2"
+)
+
+const (
+	exitOK      = 0
+	exitFailure = 1
+	exitUsage   = 2
+)
+
+const usage = `Usage: uploader <command> [flags]
+
+Commands:
+  serve                     run the web UI (default)
+  import [--tenant KD] [--since 2024-01-01]
+                            import changes since the last run, or since --since
+  backfill --since DATE [--tenant KD]
+                            re-import everything changed since DATE
+  dry-run [--tenant KD] [--since DATE] [--csv rows.csv]
+                            run the ledger import without writing anything
+                            and preview the rows it would write
+  accounts list [--tenant KD]
+                            show the chart of accounts and how codes are mapped
+  auth login                connect to Xero and save the token
+
+Run "uploader <command> -h" for the flags of a command.
+`
+
+// stringList is a flag that may be given more than once.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// run executes the command in args and returns the process exit code.
+func run(args []string) int {
+	command := "serve"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var err error
+	switch command {
+	case "serve":
+		err = runServe(args)
+	case "import":
+		err = runImport(ctx, command, args, false)
+	case "backfill":
+		err = runImport(ctx, command, args, false)
+	case "dry-run":
+		err = runImport(ctx, command, args, true)
+	case "accounts":
+		if len(args) == 0 || args[0] != "list" {
+			fmt.Fprint(os.Stderr, usage)
+			return exitUsage
+		}
+		err = runAccountsList(ctx, args[1:])
+	case "auth":
+		if len(args) == 0 || args[0] != "login" {
+			fmt.Fprint(os.Stderr, usage)
+			return exitUsage
+		}
+		err = runAuthLogin(ctx, args[1:])
+	case "help":
+		fmt.Print(usage)
+		return exitOK
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", command, usage)
+		return exitUsage
+	}
+	if errors.Is(err, flag.ErrHelp) {
+		return exitOK
+	}
+	var usageErr usageError
+	if errors.As(err, &usageErr) {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return exitFailure
+	}
+	return exitOK
+}
+
+type usageError struct {
+	msg string
+}
+
+func (e usageError) Error() string {
+	return e.msg
+}
+
+func addBQFlags(flags *flag.FlagSet) {
+	flags.StringVar(&bqDestination.ProjectID, "bq-project", envOrDefault("BQ_PROJECT", "reporting-393509"), "BigQuery project to upload to")
+	flags.StringVar(&bqDestination.DatasetID, "bq-dataset", envOrDefault("BQ_DATASET", "internal_reporting"), "BigQuery dataset to upload to")
+	flags.StringVar(&bqDestination.TableID, "bq-table", envOrDefault("BQ_TABLE", "xero_transactions"), "BigQuery table to upload to")
+	flags.StringVar(&bqInvoicesTable, "bq-invoices-table", envOrDefault("BQ_INVOICES_TABLE", "xero_invoices"), "BigQuery table to upload invoices to")
+	flags.StringVar(&bqCreditNotesTable, "bq-credit-notes-table", envOrDefault("BQ_CREDIT_NOTES_TABLE", "xero_credit_notes"), "BigQuery table to upload credit notes to")
+	flags.StringVar(&bqPaymentsTable, "bq-payments-table", envOrDefault("BQ_PAYMENTS_TABLE", "xero_payments"), "BigQuery table to upload payments to")
+	flags.StringVar(&bqOverpaymentsTable, "bq-overpayments-table", envOrDefault("BQ_OVERPAYMENTS_TABLE", "xero_overpayments"), "BigQuery table to upload overpayments to")
+	flags.StringVar(&bqPrepaymentsTable, "bq-prepayments-table", envOrDefault("BQ_PREPAYMENTS_TABLE", "xero_prepayments"), "BigQuery table to upload prepayments to")
+	flags.StringVar(&bqContactsTable, "bq-contacts-table", envOrDefault("BQ_CONTACTS_TABLE", "xero_contacts"), "BigQuery table to upload contacts to")
+	flags.StringVar(&bqTrackingTable, "bq-tracking-table", envOrDefault("BQ_TRACKING_TABLE", "xero_tracking_categories"), "BigQuery table to upload tracking categories to")
+	flags.StringVar(&bqExceptionsTable, "bq-exceptions-table", envOrDefault("BQ_EXCEPTIONS_TABLE", "xero_exceptions"), "BigQuery table to write unmapped account reports to")
+}
+
+// parseFlags parses args and loads the saved Xero token, which every command
+// needs.
+func parseFlags(flags *flag.FlagSet, args []string) error {
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() > 0 {
+		return usageError{msg: fmt.Sprintf("unexpected arguments: %s", strings.Join(flags.Args(), " "))}
+	}
+	err = loadSavedToken()
+	if err != nil {
+		return fmt.Errorf("loading saved token: %w", err)
+	}
+	return nil
+}
+
+func runServe(args []string) error {
+	flags := flag.NewFlagSet("serve", flag.ContinueOnError)
+	addBQFlags(flags)
+	err := parseFlags(flags, args)
+	if err != nil {
+		return err
+	}
+	return serve()
+}
+
+func runImport(ctx context.Context, command string, args []string, dryRun bool) error {
+	flags := flag.NewFlagSet(command, flag.ContinueOnError)
+	addBQFlags(flags)
+	tenants := stringList{}
+	flags.Var(&tenants, "tenant", "company code to import, may be repeated (default: every enabled tenant)")
+	since := flags.String("since", "", "import everything changed since this date (YYYY-MM-DD)")
+	previewCSV := new(string)
+	if dryRun {
+		previewCSV = flags.String("csv", "", "write every ledger row the import would produce to this CSV file")
+	}
+	err := parseFlags(flags, args)
+	if err != nil {
+		return err
+	}
+	opts := models.ImportOptions{Tenants: tenants, DryRun: dryRun, PreviewCSV: *previewCSV}
+	if *since != "" {
+		opts.Since, err = time.Parse("2006-01-02", *since)
+		if err != nil {
+			return usageError{msg: fmt.Sprintf("invalid --since %q, expected YYYY-MM-DD", *since)}
+		}
+	}
+	if command == "backfill" && opts.Since.IsZero() {
+		return usageError{msg: "backfill needs --since"}
+	}
+	msg, err := importXeroData(ctx, opts, printProgress)
+	if err != nil {
+		return err
+	}
+	fmt.Println(msg)
+	return nil
+}
+
+func printProgress(event models.JobEvent) {
+	parts := []string{event.Time.Format("15:04:05"), event.Tenant, event.Type}
+	if event.Endpoint != "" {
+		parts = append(parts, event.Endpoint)
+	}
+	if event.Page > 0 {
+		parts = append(parts, fmt.Sprintf("page %d", event.Page))
+	}
+	if event.Batch > 0 {
+		parts = append(parts, fmt.Sprintf("batch %d", event.Batch))
+	}
+	if event.Rows > 0 {
+		parts = append(parts, fmt.Sprintf("%d rows", event.Rows))
+	}
+	if event.Message != "" {
+		parts = append(parts, event.Message)
+	}
+	fmt.Println(strings.Join(parts, " "))
+	for _, account := range event.Unmapped {
+		fmt.Printf("  unmapped account %q: %d rows, %.2f, e.g. %s\n", account.AccountCode, account.Rows, account.Amount, strings.Join(account.SampleIDs, ", "))
+	}
+	if event.Preview != nil {
+		printPreview(*event.Preview)
+	}
+}
+
+func printPreview(preview models.DryRunPreview) {
+	writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "COMPANY\tGROUP\tREVENUE LINE\tROWS\tAMOUNT")
+	for _, group := range preview.Groups {
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%d\t%.2f %s\n", group.Company, group.Group, group.RevenueLine, group.Rows, group.Amount, group.Currency)
+	}
+	writer.Flush()
+	if len(preview.Sample) == 0 {
+		return
+	}
+	fmt.Println()
+	writer = tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "COMPANY\tID\tDATE\tACCOUNT\tGROUP\tREVENUE LINE\tAMOUNT\tDESCRIPTION")
+	for _, row := range preview.Sample {
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\t%s\t%.2f\t%s\n", row.Company, row.TransactionID, row.Date.Format("2006-01-02"), row.AccountCode, row.Group, row.RevenueLine, row.GrossAmount, row.Description)
+	}
+	writer.Flush()
+}
+
+func runAccountsList(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("accounts list", flag.ContinueOnError)
+	tenants := stringList{}
+	flags.Var(&tenants, "tenant", "company code to list, may be repeated (default: every enabled tenant)")
+	err := parseFlags(flags, args)
+	if err != nil {
+		return err
+	}
+	tokenSource := currentTokenSource()
+	if tokenSource == nil {
+		return errors.New("not connected to Xero, run \"auth login\" first")
+	}
+	config, err := loadTenants()
+	if err != nil {
+		return err
+	}
+	enabled, err := enabledTenants(config)
+	if err != nil {
+		return err
+	}
+	selected, err := selectTenants(enabled, tenants)
+	if err != nil {
+		return err
+	}
+	ruleSet, err := loadAccountRules(accountRulesPath())
+	if err != nil {
+		return err
+	}
+	writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "COMPANY\tCODE\tNAME\tGROUP\tMAPPED TO")
+	for _, tenant := range selected {
+		accountLookup, err := getAccountLookupTable(ctx, tokenSource, tenant.ID)
+		if err != nil {
+			return err
+		}
+		mapping, err := modifyAccountLookupTable(accountLookup, ruleSet, tenant.Company)
+		if err != nil {
+			return err
+		}
+		codes := []string{}
+		for code := range accountLookup {
+			codes = append(codes, code)
+		}
+		for _, rule := range mapping.rules {
+			if _, ok := accountLookup[rule.SourceCode]; !ok {
+				codes = append(codes, rule.SourceCode)
+			}
+		}
+		sort.Strings(codes)
+		now := time.Now()
+		for _, code := range codes {
+			account := accountLookup[code]
+			mapped := "(dropped)"
+			if target, ok := mapping.lookup(code, now); ok {
+				mapped = fmt.Sprintf("%s / %s", target.Name, target.Group)
+			}
+			fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\n", tenant.Company, code, account.Name, account.Group, mapped)
+		}
+	}
+	return writer.Flush()
+}
+
+// runAuthLogin runs the OAuth flow without the web UI: it serves the callback
+// URL until Xero redirects back, then saves the token.
+func runAuthLogin(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("auth login", flag.ContinueOnError)
+	err := parseFlags(flags, args)
+	if err != nil {
+		return err
+	}
+	redirectURL, err := url.Parse(oauth2Config.RedirectURL)
+	if err != nil {
+		return err
+	}
+	result := make(chan error, 1)
+	mux := http.NewServeMux()
+	mux.HandleFunc(redirectURL.Path, func(w http.ResponseWriter, r *http.Request) {
+		token, err := oauth2Config.Exchange(r.Context(), r.URL.Query().Get("code"))
+		if err == nil {
+			err = saveLoginToken(r.Context(), token)
+		}
+		if err != nil {
+			http.Error(w, "Login failed: "+err.Error(), http.StatusInternalServerError)
+		} else {
+			fmt.Fprintln(w, "Connected to Xero, you can close this window.")
+		}
+		result <- err
+	})
+	server := &http.Server{Addr: redirectURL.Host, Handler: mux}
+	go func() {
+		err := server.ListenAndServe()
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			result <- err
+		}
+	}()
+	defer server.Close()
+
+	fmt.Println("Open this URL in a browser to connect to Xero:")
+	fmt.Println(oauth2Config.AuthCodeURL(""))
+	select {
+	case err = <-result:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Println("Token saved.")
+	return nil
+}
+
+func saveLoginToken(ctx context.Context, token *oauth2.Token) error {
+	err := setToken(token)
+	if err != nil {
+		return err
+	}
+	err = discoverTenants(ctx, currentTokenSource())
+	if err != nil {
+		fmt.Println("Error discovering tenants", err)
+	}
+	return nil
+}
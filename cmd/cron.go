@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronSchedule is a parsed five field cron expression: minute, hour, day of
+// month, month and day of week. Each field supports *, lists, ranges and
+// steps, e.g. "0 * 1-3,28-31 * *" runs hourly on the first and last days of
+// the month.
+type cronSchedule struct {
+	expr                                   string
+	minutes, hours, days, months, weekdays []bool
+	daysRestricted, weekdaysRestricted     bool
+}
+
+func parseCron(expr string) (cronSchedule, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return cronSchedule{}, fmt.Errorf("cron expression %q must have 5 fields", expr)
+	}
+	schedule := cronSchedule{expr: expr}
+	var err error
+	if schedule.minutes, err = parseCronField(fields[0], 0, 59); err != nil {
+		return schedule, fmt.Errorf("cron expression %q minute: %w", expr, err)
+	}
+	if schedule.hours, err = parseCronField(fields[1], 0, 23); err != nil {
+		return schedule, fmt.Errorf("cron expression %q hour: %w", expr, err)
+	}
+	if schedule.days, err = parseCronField(fields[2], 1, 31); err != nil {
+		return schedule, fmt.Errorf("cron expression %q day of month: %w", expr, err)
+	}
+	if schedule.months, err = parseCronField(fields[3], 1, 12); err != nil {
+		return schedule, fmt.Errorf("cron expression %q month: %w", expr, err)
+	}
+	if schedule.weekdays, err = parseCronField(fields[4], 0, 7); err != nil {
+		return schedule, fmt.Errorf("cron expression %q day of week: %w", expr, err)
+	}
+	// Sunday may be written as 0 or 7.
+	schedule.weekdays[0] = schedule.weekdays[0] || schedule.weekdays[7]
+	// As in Vixie cron, a field starting with * does not restrict the day,
+	// even with a step.
+	schedule.daysRestricted = !strings.HasPrefix(fields[2], "*")
+	schedule.weekdaysRestricted = !strings.HasPrefix(fields[4], "*")
+	return schedule, nil
+}
+
+func parseCronField(field string, min int, max int) ([]bool, error) {
+	values := make([]bool, max+1)
+	for _, part := range strings.Split(field, ",") {
+		rangePart, stepPart, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			step, err = strconv.Atoi(stepPart)
+			if err != nil || step < 1 {
+				return nil, fmt.Errorf("invalid step %q", stepPart)
+			}
+		}
+		start, end := min, max
+		if rangePart != "*" {
+			startPart, endPart, isRange := strings.Cut(rangePart, "-")
+			var err error
+			start, err = strconv.Atoi(startPart)
+			if err != nil {
+				return nil, fmt.Errorf("invalid value %q", startPart)
+			}
+			end = start
+			if isRange {
+				end, err = strconv.Atoi(endPart)
+				if err != nil {
+					return nil, fmt.Errorf("invalid value %q", endPart)
+				}
+			} else if hasStep {
+				end = max
+			}
+		}
+		if start < min || end > max || start > end {
+			return nil, fmt.Errorf("%q is outside %d-%d", part, min, max)
+		}
+		for value := start; value <= end; value += step {
+			values[value] = true
+		}
+	}
+	return values, nil
+}
+
+// matches reports whether the schedule fires in the minute containing t.
+func (s cronSchedule) matches(t time.Time) bool {
+	return s.minutes[t.Minute()] && s.hours[t.Hour()] && s.months[int(t.Month())] && s.matchesDay(t)
+}
+
+// next returns the first minute after t that the schedule fires in, or the
+// zero time if it does not fire within the next five years.
+func (s cronSchedule) next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		if !s.months[int(t.Month())] {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !s.matchesDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !s.hours[t.Hour()] {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if s.minutes[t.Minute()] {
+			return t
+		}
+		t = t.Add(time.Minute)
+	}
+	return time.Time{}
+}
+
+// matchesDay follows standard cron: when both the day of month and the day
+// of week are restricted, a day matching either of them fires; otherwise a
+// day has to match both.
+func (s cronSchedule) matchesDay(t time.Time) bool {
+	dayMatch := s.days[t.Day()]
+	weekdayMatch := s.weekdays[int(t.Weekday())]
+	if s.daysRestricted && s.weekdaysRestricted {
+		return dayMatch || weekdayMatch
+	}
+	return dayMatch && weekdayMatch
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCron(t *testing.T) {
+	tests := []struct {
+		expr    string
+		wantErr bool
+	}{
+		{expr: "0 2 * * *"},
+		{expr: "*/15 * * * 1-5"},
+		{expr: "0 * 1-3,28-31 * *"},
+		{expr: "30 6 1 1,4,7,10 0"},
+		{expr: "0 0 * * 7"},
+		{expr: "5/10 * * * *"},
+		{expr: "0 2 * *", wantErr: true},
+		{expr: "0 2 * * * *", wantErr: true},
+		{expr: "60 * * * *", wantErr: true},
+		{expr: "0 24 * * *", wantErr: true},
+		{expr: "0 0 0 * *", wantErr: true},
+		{expr: "0 0 * 13 *", wantErr: true},
+		{expr: "0 0 * * 8", wantErr: true},
+		{expr: "0 0 5-1 * *", wantErr: true},
+		{expr: "*/0 * * * *", wantErr: true},
+		{expr: "a * * * *", wantErr: true},
+		{expr: "1-x * * * *", wantErr: true},
+	}
+	for _, test := range tests {
+		_, err := parseCron(test.expr)
+		if (err != nil) != test.wantErr {
+			t.Errorf("parseCron(%q) error = %v, want error %t", test.expr, err, test.wantErr)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	// 2024-01-01 is a Monday.
+	from := time.Date(2024, 1, 1, 10, 7, 30, 0, time.UTC)
+	tests := []struct {
+		expr string
+		from time.Time
+		want time.Time
+	}{
+		{expr: "* * * * *", from: from, want: time.Date(2024, 1, 1, 10, 8, 0, 0, time.UTC)},
+		{expr: "0 2 * * *", from: from, want: time.Date(2024, 1, 2, 2, 0, 0, 0, time.UTC)},
+		{expr: "*/15 * * * *", from: from, want: time.Date(2024, 1, 1, 10, 15, 0, 0, time.UTC)},
+		{expr: "0 10 * * *", from: time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC), want: time.Date(2024, 1, 2, 10, 0, 0, 0, time.UTC)},
+		{expr: "0 0 1 * *", from: from, want: time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{expr: "0 0 29 2 *", from: from, want: time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{expr: "0 0 31 * *", from: time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC), want: time.Date(2024, 3, 31, 0, 0, 0, 0, time.UTC)},
+		{expr: "0 9 * * 1-5", from: time.Date(2024, 1, 5, 12, 0, 0, 0, time.UTC), want: time.Date(2024, 1, 8, 9, 0, 0, 0, time.UTC)},
+		{expr: "0 0 * * 0", from: from, want: time.Date(2024, 1, 7, 0, 0, 0, 0, time.UTC)},
+		{expr: "0 0 * * 7", from: from, want: time.Date(2024, 1, 7, 0, 0, 0, 0, time.UTC)},
+		{expr: "0 0 1 1 *", from: from, want: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)},
+		// Both day fields restricted: either one matching fires.
+		{expr: "0 0 15 * 5", from: from, want: time.Date(2024, 1, 5, 0, 0, 0, 0, time.UTC)},
+		{expr: "0 0 3 * 5", from: from, want: time.Date(2024, 1, 3, 0, 0, 0, 0, time.UTC)},
+		// A day field starting with * does not restrict, so both must match.
+		{expr: "0 0 */2 * 1", from: from, want: time.Date(2024, 1, 15, 0, 0, 0, 0, time.UTC)},
+		{expr: "0 0 1 * */2", from: from, want: time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{expr: "0 0 30 2 *", from: from, want: time.Time{}},
+	}
+	for _, test := range tests {
+		schedule, err := parseCron(test.expr)
+		if err != nil {
+			t.Fatalf("parseCron(%q): %v", test.expr, err)
+		}
+		got := schedule.next(test.from)
+		if !got.Equal(test.want) {
+			t.Errorf("%q next after %s = %s, want %s", test.expr, test.from, got, test.want)
+		}
+		if !got.IsZero() && !schedule.matches(got) {
+			t.Errorf("%q does not match its own next time %s", test.expr, got)
+		}
+	}
+}
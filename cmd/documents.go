@@ -0,0 +1,424 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/karman-dev-team/xero-transaction-bq-uploader/models"
+	"golang.org/x/oauth2"
+)
+
+// documentSync describes a Xero document endpoint that lands in its own
+// BigQuery table with one row per document, upserted on (company, id).
+type documentSync[X any, R any] struct {
+	Endpoint string
+	Table    *string
+	Spec     bqTableSpec
+	Fetch    func(ctx context.Context, report progressFunc, tokenSource oauth2.TokenSource, tenantID string, modifiedSince time.Time, handle func([]X) error) error
+	Convert  func(document X, company string) (R, error)
+	Updated  func(document X) string
+	// HasContact is set when rows have a contact_id column and the
+	// documents can be the source of a journal.
+	HasContact bool
+}
+
+// documentImporter is a documentSync with its type parameters hidden, so
+// that the document endpoints can be imported in a loop.
+type documentImporter interface {
+	endpoint() string
+	destination(tenant models.XeroCompany) models.BQDestination
+	tableSpec() bqTableSpec
+	hasContact() bool
+	importSince(ctx context.Context, report progressFunc, tokenSource oauth2.TokenSource, tenant models.XeroCompany, modifiedSince time.Time) (int, time.Time, error)
+}
+
+// documentSyncs are imported for every tenant alongside the ledger.
+var documentSyncs = []documentImporter{
+	documentSync[models.Contact, models.BQContact]{
+		Endpoint: contactsEndpoint,
+		Table:    &bqContactsTable,
+		Spec:     contactsTableSpec,
+		Fetch:    getAllContacts,
+		Convert:  convertContact,
+		Updated:  func(contact models.Contact) string { return contact.UpdatedDateUTC },
+	},
+	documentSync[models.TrackingCategory, models.BQTrackingCategory]{
+		Endpoint: trackingEndpoint,
+		Table:    &bqTrackingTable,
+		Spec:     trackingTableSpec,
+		Fetch:    getAllTrackingCategories,
+		Convert:  convertTrackingCategory,
+		Updated:  func(category models.TrackingCategory) string { return "" },
+	},
+	documentSync[models.XeroInvoice, models.BQInvoice]{
+		Endpoint:   invoicesEndpoint,
+		Table:      &bqInvoicesTable,
+		Spec:       invoicesTableSpec,
+		Fetch:      getAllInvoices,
+		Convert:    convertInvoice,
+		Updated:    func(invoice models.XeroInvoice) string { return invoice.UpdatedDateUTC },
+		HasContact: true,
+	},
+	documentSync[models.XeroCreditNote, models.BQCreditNote]{
+		Endpoint:   creditNotesEndpoint,
+		Table:      &bqCreditNotesTable,
+		Spec:       creditNotesTableSpec,
+		Fetch:      getAllCreditNotes,
+		Convert:    convertCreditNote,
+		Updated:    func(creditNote models.XeroCreditNote) string { return creditNote.UpdatedDateUTC },
+		HasContact: true,
+	},
+	documentSync[models.XeroPayment, models.BQPayment]{
+		Endpoint:   paymentsEndpoint,
+		Table:      &bqPaymentsTable,
+		Spec:       paymentsTableSpec,
+		Fetch:      getAllPayments,
+		Convert:    convertPayment,
+		Updated:    func(payment models.XeroPayment) string { return payment.UpdatedDateUTC },
+		HasContact: true,
+	},
+	documentSync[models.XeroOverpayment, models.BQOverpayment]{
+		Endpoint:   overpaymentsEndpoint,
+		Table:      &bqOverpaymentsTable,
+		Spec:       overpaymentsTableSpec,
+		Fetch:      getAllOverpayments,
+		Convert:    convertOverpayment,
+		Updated:    func(overpayment models.XeroOverpayment) string { return overpayment.UpdatedDateUTC },
+		HasContact: true,
+	},
+	documentSync[models.XeroPrepayment, models.BQPrepayment]{
+		Endpoint:   prepaymentsEndpoint,
+		Table:      &bqPrepaymentsTable,
+		Spec:       prepaymentsTableSpec,
+		Fetch:      getAllPrepayments,
+		Convert:    convertPrepayment,
+		Updated:    func(prepayment models.XeroPrepayment) string { return prepayment.UpdatedDateUTC },
+		HasContact: true,
+	},
+}
+
+func (s documentSync[X, R]) endpoint() string {
+	return s.Endpoint
+}
+
+func (s documentSync[X, R]) destination(tenant models.XeroCompany) models.BQDestination {
+	return tenantTable(tenant, *s.Table)
+}
+
+func (s documentSync[X, R]) tableSpec() bqTableSpec {
+	return s.Spec
+}
+
+func (s documentSync[X, R]) hasContact() bool {
+	return s.HasContact
+}
+
+// importSince streams the documents changed since modifiedSince into the
+// tenant's table for them a page at a time. It returns the number of rows
+// written and the latest UpdatedDateUTC seen, to resume from next time.
+func (s documentSync[X, R]) importSince(ctx context.Context, report progressFunc, tokenSource oauth2.TokenSource, tenant models.XeroCompany, modifiedSince time.Time) (int, time.Time, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	writer, err := newBQWriter[R](ctx, report, tenant.Company, s.destination(tenant), false)
+	if err != nil {
+		return 0, modifiedSince, err
+	}
+	rows := 0
+	latest := modifiedSince
+	err = s.Fetch(ctx, report, tokenSource, tenant.ID, modifiedSince, func(page []X) error {
+		converted := make([]R, 0, len(page))
+		for _, document := range page {
+			row, err := s.Convert(document, tenant.Company)
+			if err != nil {
+				return err
+			}
+			converted = append(converted, row)
+			updated, err := parseXeroDate(s.Updated(document))
+			if err != nil {
+				return err
+			}
+			latest = maxTime(latest, updated)
+		}
+		if len(converted) == 0 {
+			return nil
+		}
+		rows += len(converted)
+		return writer.Write(ctx, converted)
+	})
+	if err != nil {
+		cancel()
+	}
+	closeErr := writer.Close(ctx)
+	if err != nil {
+		return rows, modifiedSince, err
+	}
+	if closeErr != nil {
+		return rows, modifiedSince, closeErr
+	}
+	return rows, latest, nil
+}
+
+func convertContact(contact models.Contact, company string) (models.BQContact, error) {
+	updated, err := parseXeroDate(contact.UpdatedDateUTC)
+	if err != nil {
+		return models.BQContact{}, err
+	}
+	groups := []string{}
+	for _, group := range contact.ContactGroups {
+		groups = append(groups, group.Name)
+	}
+	return models.BQContact{
+		ContactID:       contact.ContactID,
+		Company:         company,
+		Name:            contact.Name,
+		EmailAddress:    contact.EmailAddress,
+		Groups:          groups,
+		IsCustomer:      contact.IsCustomer,
+		IsSupplier:      contact.IsSupplier,
+		DefaultCurrency: contact.DefaultCurrency,
+		Status:          contact.ContactStatus,
+		Archived:        contact.ContactStatus == "ARCHIVED",
+		UpdatedAt:       updated,
+	}, nil
+}
+
+func convertTrackingCategory(category models.TrackingCategory, company string) (models.BQTrackingCategory, error) {
+	options := []models.BQTrackingOption{}
+	for _, option := range category.Options {
+		options = append(options, models.BQTrackingOption{
+			TrackingOptionID: option.TrackingOptionID,
+			Name:             option.Name,
+			Status:           option.Status,
+		})
+	}
+	return models.BQTrackingCategory{
+		TrackingCategoryID: category.TrackingCategoryID,
+		Company:            company,
+		Name:               category.Name,
+		Status:             category.Status,
+		Options:            options,
+	}, nil
+}
+
+func convertInvoice(invoice models.XeroInvoice, company string) (models.BQInvoice, error) {
+	date, dueDate, err := parseDocumentDates(invoice.DateString, invoice.DueDateString)
+	if err != nil {
+		return models.BQInvoice{}, err
+	}
+	updated, err := parseXeroDate(invoice.UpdatedDateUTC)
+	if err != nil {
+		return models.BQInvoice{}, err
+	}
+	return models.BQInvoice{
+		InvoiceID:      invoice.InvoiceID,
+		Company:        company,
+		InvoiceNumber:  invoice.InvoiceNumber,
+		Type:           invoice.Type,
+		Status:         invoice.Status,
+		ContactID:      invoice.Contact.ContactID,
+		ContactName:    invoice.Contact.Name,
+		Date:           date,
+		DueDate:        dueDate,
+		Reference:      invoice.Reference,
+		CurrencyCode:   invoice.CurrencyCode,
+		SubTotal:       invoice.SubTotal,
+		TotalTax:       invoice.TotalTax,
+		Total:          invoice.Total,
+		AmountDue:      invoice.AmountDue,
+		AmountPaid:     invoice.AmountPaid,
+		AmountCredited: invoice.AmountCredited,
+		UpdatedAt:      updated,
+		LineItems:      convertLineItems(invoice.LineItems),
+	}, nil
+}
+
+func convertCreditNote(creditNote models.XeroCreditNote, company string) (models.BQCreditNote, error) {
+	date, dueDate, err := parseDocumentDates(creditNote.DateString, creditNote.DueDateString)
+	if err != nil {
+		return models.BQCreditNote{}, err
+	}
+	updated, err := parseXeroDate(creditNote.UpdatedDateUTC)
+	if err != nil {
+		return models.BQCreditNote{}, err
+	}
+	return models.BQCreditNote{
+		CreditNoteID:     creditNote.CreditNoteID,
+		Company:          company,
+		CreditNoteNumber: creditNote.CreditNoteNumber,
+		Type:             creditNote.Type,
+		Status:           creditNote.Status,
+		ContactID:        creditNote.Contact.ContactID,
+		ContactName:      creditNote.Contact.Name,
+		Date:             date,
+		DueDate:          dueDate,
+		Reference:        creditNote.Reference,
+		CurrencyCode:     creditNote.CurrencyCode,
+		SubTotal:         creditNote.SubTotal,
+		TotalTax:         creditNote.TotalTax,
+		Total:            creditNote.Total,
+		RemainingCredit:  creditNote.RemainingCredit,
+		AppliedAmount:    creditNote.AppliedAmount,
+		UpdatedAt:        updated,
+		LineItems:        convertLineItems(creditNote.LineItems),
+	}, nil
+}
+
+// convertPayment keeps the IDs of whichever invoice, credit note,
+// prepayment or overpayment the payment settles.
+func convertPayment(payment models.XeroPayment, company string) (models.BQPayment, error) {
+	date, err := parseXeroDate(payment.Date)
+	if err != nil {
+		return models.BQPayment{}, err
+	}
+	updated, err := parseXeroDate(payment.UpdatedDateUTC)
+	if err != nil {
+		return models.BQPayment{}, err
+	}
+	contact := payment.Invoice.Contact
+	if contact.ContactID == "" {
+		contact = payment.CreditNote.Contact
+	}
+	return models.BQPayment{
+		PaymentID:        payment.PaymentID,
+		Company:          company,
+		Date:             date,
+		Amount:           payment.Amount,
+		BankAmount:       payment.BankAmount,
+		CurrencyRate:     payment.CurrencyRate,
+		Reference:        payment.Reference,
+		PaymentType:      payment.PaymentType,
+		Status:           payment.Status,
+		IsReconciled:     payment.IsReconciled,
+		AccountID:        payment.Account.AccountID,
+		AccountCode:      payment.Account.Code,
+		ContactID:        contact.ContactID,
+		ContactName:      contact.Name,
+		InvoiceID:        payment.Invoice.InvoiceID,
+		InvoiceNumber:    payment.Invoice.InvoiceNumber,
+		CreditNoteID:     payment.CreditNote.CreditNoteID,
+		CreditNoteNumber: payment.CreditNote.CreditNoteNumber,
+		PrepaymentID:     payment.Prepayment.PrepaymentID,
+		OverpaymentID:    payment.Overpayment.OverpaymentID,
+		UpdatedAt:        updated,
+	}, nil
+}
+
+func convertOverpayment(overpayment models.XeroOverpayment, company string) (models.BQOverpayment, error) {
+	date, _, err := parseDocumentDates(overpayment.DateString, "")
+	if err != nil {
+		return models.BQOverpayment{}, err
+	}
+	updated, err := parseXeroDate(overpayment.UpdatedDateUTC)
+	if err != nil {
+		return models.BQOverpayment{}, err
+	}
+	allocations, err := convertAllocations(overpayment.Allocations)
+	if err != nil {
+		return models.BQOverpayment{}, err
+	}
+	return models.BQOverpayment{
+		OverpaymentID:   overpayment.OverpaymentID,
+		Company:         company,
+		Type:            overpayment.Type,
+		Status:          overpayment.Status,
+		ContactID:       overpayment.Contact.ContactID,
+		ContactName:     overpayment.Contact.Name,
+		Date:            date,
+		CurrencyCode:    overpayment.CurrencyCode,
+		SubTotal:        overpayment.SubTotal,
+		TotalTax:        overpayment.TotalTax,
+		Total:           overpayment.Total,
+		RemainingCredit: overpayment.RemainingCredit,
+		UpdatedAt:       updated,
+		LineItems:       convertLineItems(overpayment.LineItems),
+		Allocations:     allocations,
+	}, nil
+}
+
+func convertPrepayment(prepayment models.XeroPrepayment, company string) (models.BQPrepayment, error) {
+	date, _, err := parseDocumentDates(prepayment.DateString, "")
+	if err != nil {
+		return models.BQPrepayment{}, err
+	}
+	updated, err := parseXeroDate(prepayment.UpdatedDateUTC)
+	if err != nil {
+		return models.BQPrepayment{}, err
+	}
+	allocations, err := convertAllocations(prepayment.Allocations)
+	if err != nil {
+		return models.BQPrepayment{}, err
+	}
+	return models.BQPrepayment{
+		PrepaymentID:    prepayment.PrepaymentID,
+		Company:         company,
+		Type:            prepayment.Type,
+		Status:          prepayment.Status,
+		ContactID:       prepayment.Contact.ContactID,
+		ContactName:     prepayment.Contact.Name,
+		Date:            date,
+		Reference:       prepayment.Reference,
+		CurrencyCode:    prepayment.CurrencyCode,
+		SubTotal:        prepayment.SubTotal,
+		TotalTax:        prepayment.TotalTax,
+		Total:           prepayment.Total,
+		RemainingCredit: prepayment.RemainingCredit,
+		UpdatedAt:       updated,
+		LineItems:       convertLineItems(prepayment.LineItems),
+		Allocations:     allocations,
+	}, nil
+}
+
+// convertAllocations keeps the invoices an overpayment or prepayment has
+// been allocated against.
+func convertAllocations(allocations []models.Allocation) ([]models.BQAllocation, error) {
+	bqAllocations := []models.BQAllocation{}
+	for _, allocation := range allocations {
+		date, err := parseXeroDate(allocation.Date)
+		if err != nil {
+			return nil, err
+		}
+		bqAllocations = append(bqAllocations, models.BQAllocation{
+			InvoiceID:     allocation.Invoice.InvoiceID,
+			InvoiceNumber: allocation.Invoice.InvoiceNumber,
+			Amount:        allocation.Amount,
+			Date:          date,
+		})
+	}
+	return bqAllocations, nil
+}
+
+func convertLineItems(lineItems []models.LineItem) []models.BQLineItem {
+	bqLineItems := []models.BQLineItem{}
+	for _, lineItem := range lineItems {
+		bqLineItems = append(bqLineItems, models.BQLineItem{
+			LineItemID:  lineItem.LineItemID,
+			AccountCode: lineItem.AccountCode,
+			Description: lineItem.Description,
+			Quantity:    lineItem.Quantity,
+			UnitAmount:  lineItem.UnitAmount,
+			TaxType:     lineItem.TaxType,
+			TaxAmount:   lineItem.TaxAmount,
+			LineAmount:  lineItem.LineAmount,
+			Tracking:    convertTracking(lineItem.Tracking),
+		})
+	}
+	return bqLineItems
+}
+
+// parseDocumentDates parses the date and optional due date of a document,
+// which Xero sends in the same format as bank transaction dates.
+func parseDocumentDates(dateString string, dueDateString string) (time.Time, bigquery.NullTimestamp, error) {
+	date, err := time.Parse("2006-01-02T15:04:05", dateString)
+	if err != nil {
+		return date, bigquery.NullTimestamp{}, err
+	}
+	if dueDateString == "" {
+		return date, bigquery.NullTimestamp{}, nil
+	}
+	dueDate, err := time.Parse("2006-01-02T15:04:05", dueDateString)
+	if err != nil {
+		return date, bigquery.NullTimestamp{}, err
+	}
+	return date, bigquery.NullTimestamp{Timestamp: dueDate, Valid: true}, nil
+}
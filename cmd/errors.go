@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Kinds of failure when calling Xero. A *xeroError matches its kind with
+// errors.Is, e.g. errors.Is(err, errRateLimited).
+var (
+	errRateLimited        = errors.New("rate limited")
+	errUnauthorized       = errors.New("unauthorized")
+	errTenantDisconnected = errors.New("tenant disconnected")
+	errServer             = errors.New("server error")
+	errDecode             = errors.New("decode error")
+	errNetwork            = errors.New("network error")
+	errRequest            = errors.New("request rejected")
+)
+
+type xeroError struct {
+	Kind       error
+	TenantID   string
+	Endpoint   string
+	Page       int
+	StatusCode int
+	RetryAfter time.Duration
+	Err        error
+}
+
+func (e *xeroError) Error() string {
+	msg := fmt.Sprintf("xero %s", e.Endpoint)
+	if e.Page > 0 {
+		msg += fmt.Sprintf(" page %d", e.Page)
+	}
+	msg += fmt.Sprintf(" for tenant %s: %v", e.TenantID, e.Kind)
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+func (e *xeroError) Unwrap() []error {
+	return []error{e.Kind, e.Err}
+}
+
+// retryable reports whether the request may succeed if it is sent again.
+func (e *xeroError) retryable() bool {
+	if e.Kind == errRateLimited {
+		return e.RetryAfter <= xeroMaxRetryAfter
+	}
+	return e.Kind == errServer || e.Kind == errNetwork
+}
+
+// statusError classifies a non-200 response from Xero.
+func statusError(resp *http.Response, body []byte, tenantID string, endpoint string) *xeroError {
+	xerr := &xeroError{
+		TenantID:   tenantID,
+		Endpoint:   endpoint,
+		StatusCode: resp.StatusCode,
+		Err:        fmt.Errorf("unexpected status: %s: %s", resp.Status, truncate(string(body), 200)),
+	}
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests:
+		xerr.Kind = errRateLimited
+		seconds, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+		if err == nil {
+			xerr.RetryAfter = time.Duration(seconds) * time.Second
+		}
+	case resp.StatusCode == http.StatusUnauthorized:
+		xerr.Kind = errUnauthorized
+	case resp.StatusCode == http.StatusForbidden:
+		// Xero answers 403 when the tenant is no longer connected to the app.
+		xerr.Kind = errTenantDisconnected
+	case resp.StatusCode >= 500:
+		xerr.Kind = errServer
+	default:
+		xerr.Kind = errRequest
+	}
+	return xerr
+}
+
+// atPage records the page a Xero error happened on.
+func atPage(err error, page int) error {
+	var xerr *xeroError
+	if errors.As(err, &xerr) {
+		xerr.Page = page
+	}
+	return err
+}
+
+// withRetry calls fn until it succeeds, returns an error that is not
+// retryable, or XERO_MAX_RETRIES retries have failed. Retries back off
+// exponentially from one second, or wait for Retry-After when Xero sends it.
+func withRetry(ctx context.Context, fn func() error) error {
+	maxRetries, err := strconv.Atoi(envOrDefault("XERO_MAX_RETRIES", "5"))
+	if err != nil {
+		return fmt.Errorf("parsing XERO_MAX_RETRIES: %w", err)
+	}
+	backoff := time.Second
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		var xerr *xeroError
+		if err == nil || !errors.As(err, &xerr) || !xerr.retryable() || attempt >= maxRetries {
+			return err
+		}
+		wait := backoff + time.Duration(rand.Int63n(int64(backoff/2)))
+		if xerr.RetryAfter > 0 {
+			wait = xerr.RetryAfter
+		}
+		fmt.Printf("Retrying in %s: %v\n", wait.Round(time.Millisecond), err)
+		err = sleepContext(ctx, wait)
+		if err != nil {
+			return err
+		}
+		backoff = min(backoff*2, time.Minute)
+	}
+}
+
+func truncate(s string, length int) string {
+	if len(s) <= length {
+		return s
+	}
+	return s[:length] + "..."
+}
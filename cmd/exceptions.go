@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/karman-dev-team/xero-transaction-bq-uploader/models"
+)
+
+// maxExceptionSamples is how many transaction IDs are kept per unmapped code.
+const maxExceptionSamples = 5
+
+// maxExceptionRowIDs is how many superseded row IDs are kept per account
+// code. The rest can still be found by their superseded flag.
+const maxExceptionRowIDs = 1000
+
+// Kinds of rows in the exceptions table.
+const (
+	exceptionUnmapped    = "unmapped_account"
+	exceptionSuperseded  = "superseded"
+	exceptionMissingRate = "missing_fx_rate"
+)
+
+// unmappedAccounts counts the rows dropped because their account code is not
+// in the account mapping, by code. Rows dropped by a delete rule are not
+// counted, as that is intended.
+type unmappedAccounts struct {
+	byCode map[string]*models.UnmappedAccount
+	rows   int
+}
+
+func newUnmappedAccounts() *unmappedAccounts {
+	return &unmappedAccounts{byCode: make(map[string]*models.UnmappedAccount)}
+}
+
+func (u *unmappedAccounts) add(transaction models.AccountTransaction) {
+	account, ok := u.byCode[transaction.AccountCode]
+	if !ok {
+		account = &models.UnmappedAccount{AccountCode: transaction.AccountCode}
+		u.byCode[transaction.AccountCode] = account
+	}
+	account.Rows++
+	account.Amount += transaction.GrossAmount
+	if len(account.SampleIDs) < maxExceptionSamples {
+		account.SampleIDs = append(account.SampleIDs, transaction.TransactionID)
+	}
+	u.rows++
+}
+
+// list returns the unmapped codes, most rows first.
+func (u *unmappedAccounts) list() []models.UnmappedAccount {
+	accounts := []models.UnmappedAccount{}
+	for _, account := range u.byCode {
+		accounts = append(accounts, *account)
+	}
+	sort.Slice(accounts, func(i, j int) bool {
+		if accounts[i].Rows != accounts[j].Rows {
+			return accounts[i].Rows > accounts[j].Rows
+		}
+		return accounts[i].AccountCode < accounts[j].AccountCode
+	})
+	return accounts
+}
+
+// unmappedThreshold returns how many unmapped rows a tenant may have before
+// its import fails, from UNMAPPED_ROWS_THRESHOLD. It is -1, meaning no
+// limit, when the variable is not set.
+func unmappedThreshold() (int, error) {
+	value := envOrDefault("UNMAPPED_ROWS_THRESHOLD", "")
+	if value == "" {
+		return -1, nil
+	}
+	threshold, err := strconv.Atoi(value)
+	if err != nil || threshold < 0 {
+		return 0, fmt.Errorf("UNMAPPED_ROWS_THRESHOLD must be zero or a positive number, got %q", value)
+	}
+	return threshold, nil
+}
+
+// reportExceptions publishes the exceptions report of one tenant's import,
+// the rows with unmapped account codes, the bank transaction rows removed as
+// duplicates and the rows without an FX rate, and when write is set appends
+// it to the exceptions table.
+func reportExceptions(ctx context.Context, write bool, report progressFunc, runID string, tenant models.XeroCompany, result pipelineResult) error {
+	unmapped, superseded, missing := result.Unmapped, result.Superseded, result.MissingRates
+	accounts := unmapped.list()
+	if len(accounts) > 0 {
+		fmt.Printf("%d rows for %s have unmapped account codes\n", unmapped.rows, tenant.Company)
+		report.send(models.JobEvent{Type: "exceptions", Rows: unmapped.rows, Unmapped: accounts})
+	}
+	if superseded.rows > 0 {
+		fmt.Printf("Removed %d bank transaction rows for %s that duplicate journal lines\n", superseded.rows, tenant.Company)
+	}
+	report.send(models.JobEvent{Type: "reconciled", Rows: superseded.rows, Message: "bank transaction rows superseded by journals"})
+	if missing.rows > 0 {
+		fmt.Printf("%d rows for %s have no FX rate to their reporting currency\n", missing.rows, tenant.Company)
+		report.send(models.JobEvent{Type: "fx", Rows: missing.rows, Message: "rows without an FX rate, reporting_amount left empty"})
+	}
+	if !write {
+		return nil
+	}
+	now := time.Now()
+	rows := []models.BQException{}
+	for _, account := range accounts {
+		rows = append(rows, models.BQException{
+			Kind:        exceptionUnmapped,
+			AccountCode: account.AccountCode,
+			Rows:        account.Rows,
+			Amount:      account.Amount,
+			SampleIDs:   account.SampleIDs,
+		})
+	}
+	rows = append(rows, superseded.list()...)
+	rows = append(rows, missing.list()...)
+	if len(rows) == 0 {
+		return nil
+	}
+	for i := range rows {
+		rows[i].RunID = runID
+		rows[i].RunAt = now
+		rows[i].Company = tenant.Company
+	}
+	return loadRows(ctx, tenantTable(tenant, bqExceptionsTable), rows)
+}
+
+// loadRows appends rows to destination with a load job. Unlike streaming
+// inserts, load jobs work straight after the table has been created.
+func loadRows[T any](ctx context.Context, destination models.BQDestination, rows []T) error {
+	var row T
+	schema, err := bigquery.InferSchema(row)
+	if err != nil {
+		return err
+	}
+	var data bytes.Buffer
+	encoder := json.NewEncoder(&data)
+	for _, row := range rows {
+		values, _, err := (&bigquery.StructSaver{Struct: row, Schema: schema}).Save()
+		if err != nil {
+			return err
+		}
+		err = encoder.Encode(values)
+		if err != nil {
+			return err
+		}
+	}
+	client, err := bigquery.NewClient(ctx, destination.ProjectID)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	source := bigquery.NewReaderSource(&data)
+	source.SourceFormat = bigquery.JSON
+	source.Schema = schema
+	loader := client.Dataset(destination.DatasetID).Table(destination.TableID).LoaderFrom(source)
+	loader.WriteDisposition = bigquery.WriteAppend
+	job, err := loader.Run(ctx)
+	if err != nil {
+		return err
+	}
+	status, err := job.Wait(ctx)
+	if err != nil {
+		return err
+	}
+	return status.Err()
+}
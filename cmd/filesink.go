@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/karman-dev-team/xero-transaction-bq-uploader/models"
+)
+
+// fileFormat is a file type the file sinks can write rows in.
+type fileFormat struct {
+	extension  string
+	newEncoder func(w io.Writer, schema bigquery.Schema) (rowEncoder, error)
+}
+
+var (
+	fileFormatCSV     = fileFormat{extension: "csv", newEncoder: newCSVEncoder}
+	fileFormatNDJSON  = fileFormat{extension: "ndjson", newEncoder: newNDJSONEncoder}
+	fileFormatParquet = fileFormat{extension: "parquet", newEncoder: newParquetEncoder}
+)
+
+// rowEncoder writes rows, as saved for BigQuery, to a file. close finishes
+// the file but does not close the underlying writer.
+type rowEncoder interface {
+	encode(rows []map[string]bigquery.Value) error
+	close() error
+}
+
+// fileSink writes the rows to files under OUTPUT_DIR with the columns of the
+// BigQuery table. Files are partitioned Hive style by company and month of
+// the transaction date:
+//
+//	<dir>/<dataset>/<table>/company=<company>/month=<YYYY-MM>/<run>-<full|incremental>.<extension>
+//
+// The files are raw: every run adds its own, named so that they sort by the
+// time the run started, and nothing written earlier is changed. Rows carry
+// the deleted flag from Xero and the superseded flag for bank transactions
+// duplicating a journal of the same run, but the steps that run on the
+// BigQuery table afterwards are not applied. So readers should:
+//   - ignore the files older than the company's latest full sync, which
+//     replaces everything before it, as a full sync does in BigQuery;
+//   - take the rows of a bank transaction, by source_id, from the latest file
+//     that has it, as lines removed from it are not sent again;
+//   - keep the latest row per id of what is left;
+//   - leave out the deleted and superseded rows.
+//
+// Bank transactions duplicating a journal imported by an earlier run are
+// only flagged in BigQuery. Without a BigQuery sink the ledger's sync state
+// does not move, so every run is a full sync.
+type fileSink struct {
+	dir    string
+	format fileFormat
+}
+
+func newFileSink(format fileFormat) (fileSink, error) {
+	return fileSink{dir: envOrDefault("OUTPUT_DIR", "output"), format: format}, nil
+}
+
+func (s fileSink) open(ctx context.Context, report progressFunc, tenant models.XeroCompany, runID string, fullSync bool) (rowWriter[models.BQTransaction], error) {
+	schema, err := bigquery.InferSchema(models.BQTransaction{})
+	if err != nil {
+		return nil, err
+	}
+	destination := tenantDestination(tenant)
+	return &fileWriter{
+		dir:        filepath.Join(s.dir, destination.DatasetID, destination.TableID, "company="+tenant.Company),
+		name:       fmt.Sprintf("%s-%s-%s.%s", time.Now().UTC().Format("20060102T150405Z"), runID, syncKind(fullSync), s.format.extension),
+		format:     s.format,
+		schema:     schema,
+		report:     report,
+		partitions: make(map[string]*partitionFile),
+	}, nil
+}
+
+func syncKind(fullSync bool) string {
+	if fullSync {
+		return "full"
+	}
+	return "incremental"
+}
+
+// fileWriter writes one company's rows to a file per month. Files are written
+// under a temporary name and only renamed into place by a successful Close.
+type fileWriter struct {
+	dir        string
+	name       string
+	format     fileFormat
+	schema     bigquery.Schema
+	report     progressFunc
+	partitions map[string]*partitionFile
+	rows       int
+}
+
+type partitionFile struct {
+	path    string
+	file    *os.File
+	encoder rowEncoder
+}
+
+func (w *fileWriter) Write(ctx context.Context, rows []models.BQTransaction) error {
+	order := []string{}
+	batches := make(map[string][]map[string]bigquery.Value)
+	for _, row := range rows {
+		values, err := saveRow(row, w.schema)
+		if err != nil {
+			return err
+		}
+		partition := "month=" + row.Date.Format("2006-01")
+		if _, ok := batches[partition]; !ok {
+			order = append(order, partition)
+		}
+		batches[partition] = append(batches[partition], values)
+	}
+	for _, partition := range order {
+		file, err := w.partition(partition)
+		if err != nil {
+			return err
+		}
+		err = file.encoder.encode(batches[partition])
+		if err != nil {
+			return fmt.Errorf("writing %s: %w", file.path, err)
+		}
+	}
+	w.rows += len(rows)
+	w.report.send(models.JobEvent{Type: "written", Endpoint: w.format.extension, Rows: w.rows})
+	return nil
+}
+
+// partition returns the open file of a partition, creating it on first use.
+func (w *fileWriter) partition(partition string) (*partitionFile, error) {
+	if file, ok := w.partitions[partition]; ok {
+		return file, nil
+	}
+	dir := filepath.Join(w.dir, partition)
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, w.name)
+	file, err := os.Create(path + ".tmp")
+	if err != nil {
+		return nil, err
+	}
+	encoder, err := w.format.newEncoder(file, w.schema)
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, err
+	}
+	w.partitions[partition] = &partitionFile{path: path, file: file, encoder: encoder}
+	return w.partitions[partition], nil
+}
+
+// Close finishes every month's file before renaming any of them, and removes
+// the renamed ones again if a rename fails, so that either all of the files
+// are in place or none is.
+func (w *fileWriter) Close(ctx context.Context) error {
+	errs := []error{}
+	for _, partition := range w.partitions {
+		err := errors.Join(partition.encoder.close(), partition.file.Close())
+		if err != nil {
+			errs = append(errs, fmt.Errorf("writing %s: %w", partition.path, err))
+		}
+	}
+	if len(errs) == 0 && ctx.Err() == nil {
+		renamed := []string{}
+		for _, partition := range w.partitions {
+			err := os.Rename(partition.file.Name(), partition.path)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("writing %s: %w", partition.path, err))
+				break
+			}
+			renamed = append(renamed, partition.path)
+		}
+		if len(errs) == 0 {
+			return nil
+		}
+		for _, path := range renamed {
+			os.Remove(path)
+		}
+	}
+	for _, partition := range w.partitions {
+		os.Remove(partition.file.Name())
+	}
+	return errors.Join(errs...)
+}
+
+// saveRow returns the values BigQuery would store for row, with the nullable
+// types replaced by nil or their value, as the encoders expect.
+func saveRow(row any, schema bigquery.Schema) (map[string]bigquery.Value, error) {
+	values, _, err := (&bigquery.StructSaver{Struct: row, Schema: schema}).Save()
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range values {
+		switch value := value.(type) {
+		case bigquery.NullString:
+			values[name] = nil
+			if value.Valid {
+				values[name] = value.StringVal
+			}
+		case bigquery.NullInt64:
+			values[name] = nil
+			if value.Valid {
+				values[name] = value.Int64
+			}
+		case bigquery.NullFloat64:
+			values[name] = nil
+			if value.Valid {
+				values[name] = value.Float64
+			}
+		case bigquery.NullBool:
+			values[name] = nil
+			if value.Valid {
+				values[name] = value.Bool
+			}
+		case bigquery.NullTimestamp:
+			values[name] = nil
+			if value.Valid {
+				values[name] = value.Timestamp
+			}
+		}
+	}
+	return values, nil
+}
+
+type csvEncoder struct {
+	writer *csv.Writer
+	schema bigquery.Schema
+}
+
+// newCSVEncoder writes a header of the column names, then a record per row.
+// Timestamps are RFC 3339 and repeated columns are JSON.
+func newCSVEncoder(w io.Writer, schema bigquery.Schema) (rowEncoder, error) {
+	encoder := &csvEncoder{writer: csv.NewWriter(w), schema: schema}
+	header := []string{}
+	for _, field := range schema {
+		header = append(header, field.Name)
+	}
+	err := encoder.writer.Write(header)
+	if err != nil {
+		return nil, err
+	}
+	return encoder, nil
+}
+
+func (e *csvEncoder) encode(rows []map[string]bigquery.Value) error {
+	for _, values := range rows {
+		record := []string{}
+		for _, field := range e.schema {
+			switch value := values[field.Name].(type) {
+			case nil:
+				record = append(record, "")
+			case time.Time:
+				record = append(record, value.Format(time.RFC3339))
+			default:
+				if field.Repeated || field.Type == bigquery.RecordFieldType {
+					data, err := json.Marshal(value)
+					if err != nil {
+						return err
+					}
+					record = append(record, string(data))
+				} else {
+					record = append(record, fmt.Sprint(value))
+				}
+			}
+		}
+		err := e.writer.Write(record)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *csvEncoder) close() error {
+	e.writer.Flush()
+	return e.writer.Error()
+}
+
+// ndjsonEncoder writes a JSON object per line, as loaded into BigQuery.
+type ndjsonEncoder struct {
+	encoder *json.Encoder
+}
+
+func newNDJSONEncoder(w io.Writer, schema bigquery.Schema) (rowEncoder, error) {
+	return &ndjsonEncoder{encoder: json.NewEncoder(w)}, nil
+}
+
+func (e *ndjsonEncoder) encode(rows []map[string]bigquery.Value) error {
+	for _, values := range rows {
+		err := e.encoder.Encode(values)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *ndjsonEncoder) close() error {
+	return nil
+}
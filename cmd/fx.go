@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/karman-dev-team/xero-transaction-bq-uploader/models"
+)
+
+var rateColumns = []string{"date", "from_currency", "to_currency", "rate"}
+
+// rateSource supplies exchange rates for converting amounts to the reporting
+// currency. rate returns how many units of to one unit of from is worth on
+// date, and false when the source has no rate for that pair.
+type rateSource interface {
+	rate(from string, to string, date time.Time) (float64, bool)
+}
+
+var rateSourceBackends = map[string]func() (rateSource, error){
+	"none": func() (rateSource, error) {
+		return noRates{}, nil
+	},
+	"csv": func() (rateSource, error) {
+		return loadRateTable(envOrDefault("FX_RATES_FILE", "fx_rates.csv"))
+	},
+}
+
+func newRateSource() (rateSource, error) {
+	name := envOrDefault("FX_RATE_SOURCE", "csv")
+	factory, ok := rateSourceBackends[name]
+	if !ok {
+		names := []string{}
+		for backend := range rateSourceBackends {
+			names = append(names, backend)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown FX_RATE_SOURCE %q, expected one of %s", name, strings.Join(names, ", "))
+	}
+	return factory()
+}
+
+type noRates struct{}
+
+func (noRates) rate(from string, to string, date time.Time) (float64, bool) {
+	return 0, false
+}
+
+// rateTable holds dated rates per currency pair, sorted by date. A rate
+// applies from its date until the next rate for the pair.
+type rateTable struct {
+	rates map[string][]datedRate
+}
+
+type datedRate struct {
+	date time.Time
+	rate float64
+}
+
+// loadRateTable reads a CSV with the columns in rateColumns, where rate is
+// how many units of to_currency one from_currency buys from date onwards.
+// A missing file is an empty table.
+func loadRateTable(path string) (*rateTable, error) {
+	table := &rateTable{rates: make(map[string][]datedRate)}
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return table, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading FX rates: %w", err)
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = len(rateColumns)
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for i, column := range rateColumns {
+		if strings.TrimSpace(header[i]) != column {
+			return nil, fmt.Errorf("%s: expected column %d to be %q, got %q", path, i+1, column, header[i])
+		}
+	}
+	for {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		line, _ := reader.FieldPos(0)
+		date, err := time.Parse("2006-01-02", strings.TrimSpace(record[0]))
+		if err != nil {
+			return nil, fmt.Errorf("%s line %d: date: %w", path, line, err)
+		}
+		rate, err := strconv.ParseFloat(strings.TrimSpace(record[3]), 64)
+		if err != nil || rate <= 0 {
+			return nil, fmt.Errorf("%s line %d: rate must be a positive number, got %q", path, line, record[3])
+		}
+		pair := ratePair(strings.TrimSpace(record[1]), strings.TrimSpace(record[2]))
+		table.rates[pair] = append(table.rates[pair], datedRate{date: date, rate: rate})
+	}
+	for _, rates := range table.rates {
+		sort.Slice(rates, func(i, j int) bool { return rates[i].date.Before(rates[j].date) })
+	}
+	return table, nil
+}
+
+// rate looks the pair up in both directions.
+func (t *rateTable) rate(from string, to string, date time.Time) (float64, bool) {
+	if rate, ok := t.latest(ratePair(from, to), date); ok {
+		return rate, true
+	}
+	if rate, ok := t.latest(ratePair(to, from), date); ok {
+		return 1 / rate, true
+	}
+	return 0, false
+}
+
+func (t *rateTable) latest(pair string, date time.Time) (float64, bool) {
+	rates := t.rates[pair]
+	i := sort.Search(len(rates), func(i int) bool { return rates[i].date.After(date) })
+	if i == 0 {
+		return 0, false
+	}
+	return rates[i-1].rate, true
+}
+
+func ratePair(from string, to string) string {
+	return strings.ToUpper(from) + "/" + strings.ToUpper(to)
+}
+
+// reportingCurrency returns the currency every row is converted to, from
+// REPORTING_CURRENCY, or baseCurrency when it is not set so that tenants need
+// no FX rates by default.
+func reportingCurrency(baseCurrency string) string {
+	return strings.ToUpper(envOrDefault("REPORTING_CURRENCY", baseCurrency))
+}
+
+// fxConverter converts a tenant's amounts to the reporting currency.
+type fxConverter struct {
+	baseCurrency      string
+	reportingCurrency string
+	rates             rateSource
+}
+
+// toReporting converts amount, in currency at the Xero currencyRate (units
+// of currency per unit of the base currency), to the reporting currency. The
+// transaction's own rate takes it to the base currency and the rate source
+// the rest of the way; when the amount is already in the reporting currency
+// neither is needed. When the rate source has no rate it returns the pair it
+// was missing, such as "USD/GBP", instead.
+func (c fxConverter) toReporting(amount float64, currency string, currencyRate float64, date time.Time) (float64, string) {
+	if strings.EqualFold(currency, c.reportingCurrency) {
+		return amount, ""
+	}
+	if !strings.EqualFold(currency, c.baseCurrency) {
+		if currencyRate == 0 {
+			rate, ok := c.rates.rate(currency, c.reportingCurrency, date)
+			if !ok {
+				return 0, ratePair(currency, c.reportingCurrency)
+			}
+			return amount * rate, ""
+		}
+		amount /= currencyRate
+	}
+	if strings.EqualFold(c.baseCurrency, c.reportingCurrency) {
+		return amount, ""
+	}
+	rate, ok := c.rates.rate(c.baseCurrency, c.reportingCurrency, date)
+	if !ok {
+		return 0, ratePair(c.baseCurrency, c.reportingCurrency)
+	}
+	return amount * rate, ""
+}
+
+// missingRates counts the rows left without a reporting amount because the
+// rate source has no rate for their currency pair.
+type missingRates struct {
+	byPair map[string]*models.BQException
+	rows   int
+}
+
+func newMissingRates() *missingRates {
+	return &missingRates{byPair: make(map[string]*models.BQException)}
+}
+
+func (m *missingRates) add(pair string, transaction models.AccountTransaction) {
+	exception, ok := m.byPair[pair]
+	if !ok {
+		exception = &models.BQException{Kind: exceptionMissingRate, CurrencyPair: pair}
+		m.byPair[pair] = exception
+	}
+	exception.Rows++
+	exception.Amount += transaction.GrossAmount
+	if len(exception.SampleIDs) < maxExceptionSamples {
+		exception.SampleIDs = append(exception.SampleIDs, transaction.TransactionID)
+	}
+	m.rows++
+}
+
+// list returns the missing pairs, ordered by pair.
+func (m *missingRates) list() []models.BQException {
+	exceptions := []models.BQException{}
+	for _, exception := range m.byPair {
+		exceptions = append(exceptions, *exception)
+	}
+	sort.Slice(exceptions, func(i, j int) bool {
+		return exceptions[i].CurrencyPair < exceptions[j].CurrencyPair
+	})
+	return exceptions
+}
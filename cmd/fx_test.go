@@ -0,0 +1,90 @@
+package main
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFXConverter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fx_rates.csv")
+	err := os.WriteFile(path, []byte("date,from_currency,to_currency,rate\n2024-01-01,gbp,USD,1.25\n2024-07-01,GBP,USD,1.30\n2024-01-01,EUR,USD,1.10\n"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rates, err := loadRateTable(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jan := time.Date(2024, 1, 15, 0, 0, 0, 0, time.UTC)
+	aug := time.Date(2024, 8, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name        string
+		converter   fxConverter
+		amount      float64
+		currency    string
+		rate        float64
+		date        time.Time
+		want        float64
+		wantMissing string
+	}{
+		{name: "base is reporting", converter: fxConverter{baseCurrency: "GBP", reportingCurrency: "GBP", rates: noRates{}}, amount: 100, currency: "GBP", rate: 1, date: jan, want: 100},
+		{name: "foreign to base at the Xero rate", converter: fxConverter{baseCurrency: "GBP", reportingCurrency: "GBP", rates: noRates{}}, amount: 125, currency: "USD", rate: 1.25, date: jan, want: 100},
+		{name: "already in reporting currency", converter: fxConverter{baseCurrency: "GBP", reportingCurrency: "USD", rates: noRates{}}, amount: 100, currency: "usd", rate: 1.25, date: jan, want: 100},
+		{name: "base to reporting", converter: fxConverter{baseCurrency: "GBP", reportingCurrency: "USD", rates: rates}, amount: 100, currency: "GBP", rate: 1, date: jan, want: 125},
+		{name: "later rate applies", converter: fxConverter{baseCurrency: "GBP", reportingCurrency: "USD", rates: rates}, amount: 100, currency: "GBP", rate: 1, date: aug, want: 130},
+		{name: "inverse pair", converter: fxConverter{baseCurrency: "USD", reportingCurrency: "GBP", rates: rates}, amount: 125, currency: "USD", rate: 1, date: jan, want: 100},
+		{name: "foreign through base", converter: fxConverter{baseCurrency: "GBP", reportingCurrency: "USD", rates: rates}, amount: 120, currency: "EUR", rate: 1.2, date: jan, want: 125},
+		{name: "foreign without Xero rate", converter: fxConverter{baseCurrency: "GBP", reportingCurrency: "USD", rates: rates}, amount: 100, currency: "EUR", date: jan, want: 110},
+		{name: "before the first rate", converter: fxConverter{baseCurrency: "GBP", reportingCurrency: "USD", rates: rates}, amount: 100, currency: "GBP", rate: 1, date: time.Date(2023, 12, 31, 0, 0, 0, 0, time.UTC), wantMissing: "GBP/USD"},
+		{name: "no rates", converter: fxConverter{baseCurrency: "GBP", reportingCurrency: "USD", rates: noRates{}}, amount: 100, currency: "GBP", rate: 1, date: jan, wantMissing: "GBP/USD"},
+		{name: "no rate for a foreign currency", converter: fxConverter{baseCurrency: "GBP", reportingCurrency: "USD", rates: rates}, amount: 100, currency: "NZD", date: jan, wantMissing: "NZD/USD"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, missing := test.converter.toReporting(test.amount, test.currency, test.rate, test.date)
+			if missing != test.wantMissing {
+				t.Fatalf("missing = %q, want %q", missing, test.wantMissing)
+			}
+			if math.Abs(got-test.want) > 1e-9 {
+				t.Errorf("amount = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestLoadRateTable(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		wantErr string
+	}{
+		{name: "wrong header", data: "date,from,to_currency,rate\n", wantErr: "expected column 2"},
+		{name: "bad date", data: "date,from_currency,to_currency,rate\n2024-02-30,GBP,USD,1.2\n", wantErr: "line 2: date"},
+		{name: "bad rate", data: "date,from_currency,to_currency,rate\n2024-01-01,GBP,USD,0\n", wantErr: "rate must be a positive number"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "fx_rates.csv")
+			err := os.WriteFile(path, []byte(test.data), 0o644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = loadRateTable(path)
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("error = %v, want one containing %q", err, test.wantErr)
+			}
+		})
+	}
+	table, err := loadRateTable(filepath.Join(t.TempDir(), "missing.csv"))
+	if err != nil || len(table.rates) != 0 {
+		t.Errorf("missing file = %v, %v", table, err)
+	}
+	_, err = loadRateTable(filepath.Join("..", "fx_rates.example.csv"))
+	if err != nil {
+		t.Error(err)
+	}
+}
@@ -1,11 +1,15 @@
 package main
 
 import (
+	"context"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"html/template"
 	"net/http"
-	"os"
-	"text/template"
+	"strings"
+	"time"
 
 	"github.com/karman-dev-team/xero-transaction-bq-uploader/models"
 )
@@ -22,7 +26,11 @@ func handleCallback(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Failed to exchange token: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
-	App.Oauth2Token = token
+	err = saveLoginToken(r.Context(), token)
+	if err != nil {
+		http.Error(w, "Failed to save token: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
 	http.Redirect(w, r, "/", http.StatusFound)
 }
 
@@ -35,9 +43,17 @@ func handleHome(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	if App.Oauth2Token != nil {
+	if currentTokenSource() != nil {
 		pageData.TokenSet = true
 	}
+	config, err := loadTenants()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	pageData.Tenants = config.Tenants
+	pageData.ScheduledRuns = recentScheduledRuns()
+	pageData.NextRuns = nextScheduledRuns(config, time.Now())
 	err = tmpl.Execute(w, pageData)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -46,58 +62,170 @@ func handleHome(w http.ResponseWriter, r *http.Request) {
 }
 
 func handleImport(w http.ResponseWriter, r *http.Request) {
-	msg, err := importXeroData()
-	response := map[string]string{
-		"message": msg,
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
 	}
+	response := map[string]string{}
+	status := http.StatusAccepted
+	opts := models.ImportOptions{DryRun: r.FormValue("dry_run") == "true"}
+	previewID := ""
+	if opts.DryRun {
+		removeOldPreviews(time.Now())
+		var err error
+		previewID, err = newJobID()
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"message": err.Error()})
+			return
+		}
+		opts.PreviewCSV = previewCSVPath(previewID)
+	}
+	job, err := startImportJob(func(ctx context.Context, report progressFunc) (string, error) {
+		return importXeroData(ctx, opts, report)
+	})
 	if err != nil {
 		response["message"] = err.Error()
-		fmt.Println(err)
+		status = http.StatusInternalServerError
+	} else {
+		response["job_id"] = job.snapshot().ID
+		response["message"] = "Import started"
+		if opts.DryRun {
+			response["message"] = "Dry run started"
+			response["preview_csv"] = fmt.Sprintf("/previews/%s.csv", previewID)
+		}
+	}
+	writeJSON(w, status, response)
+}
+
+// handlePreviews serves /previews/{id}.csv, the rows of a dry run.
+func handlePreviews(w http.ResponseWriter, r *http.Request) {
+	id, ok := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/previews/"), ".csv")
+	if _, err := hex.DecodeString(id); !ok || id == "" || err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"dry-run-%s.csv\"", id))
+	http.ServeFile(w, r, previewCSVPath(id))
+}
+
+// handleJobs serves /jobs/{id}, /jobs/{id}/events and /jobs/{id}/cancel.
+func handleJobs(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/jobs/"), "/"), "/")
+	job, ok := getImportJob(parts[0])
+	if !ok {
+		http.Error(w, "Unknown job", http.StatusNotFound)
+		return
+	}
+	action := ""
+	if len(parts) > 1 {
+		action = parts[1]
+	}
+	switch action {
+	case "":
+		writeJSON(w, http.StatusOK, job.snapshot())
+	case "events":
+		streamJobEvents(w, r, job)
+	case "cancel":
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		job.cancel()
+		writeJSON(w, http.StatusAccepted, job.snapshot())
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// streamJobEvents sends a job's events as Server-Sent Events until the job
+// finishes or the client goes away.
+func streamJobEvents(w http.ResponseWriter, r *http.Request, job *importJob) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	history, events := job.subscribe()
+	defer job.unsubscribe(events)
+	for _, event := range history {
+		err := writeEvent(w, event)
+		if err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			err := writeEvent(w, event)
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+		}
 	}
+}
 
-	jsonResponse, err := json.Marshal(response)
+func writeEvent(w http.ResponseWriter, event models.JobEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+	return err
+}
+
+func writeJSON(w http.ResponseWriter, status int, value any) {
+	jsonResponse, err := json.Marshal(value)
 	if err != nil {
 		http.Error(w, "Error encoding JSON response", http.StatusInternalServerError)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
 	w.Write(jsonResponse)
 }
 
-func importXeroData() (string, error) {
-	tenantID := []models.XeroCompany{
-		{ID: os.Getenv("CF_TENANT_ID"), Company: "CF"},
-		{ID: os.Getenv("KD_TENANT_ID"), Company: "KD"}}
-	var accountLookup = make(map[string]models.AccountLookup)
-	for _, tenant := range tenantID {
-		tempLookup, err := getAccountLookupTable(App.Oauth2Token, tenant.ID)
-		if err != nil {
-			return "Error", err
-		}
-		for key, value := range tempLookup {
-			accountLookup[key] = value
-		}
+var errUnknownTenant = errors.New("unknown tenant")
+
+func handleTenants(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
 	}
-	accountLookup = modifyAccountLookupTable(accountLookup)
-	for _, tenant := range tenantID {
-		transactions, err := getAllTransactions(App.Oauth2Token, tenant.ID)
-		if err != nil {
-			return "Error", err
-		}
-		journals, err := getAllJournals(App.Oauth2Token, tenant.ID)
-		if err != nil {
-			return "Error", err
-		}
-		entries, err := mergeTransactionsAndJournals(transactions, journals)
-		if err != nil {
-			return "Error", err
-		}
-		fmt.Println("Number of entries: ", len(entries))
-		err = uploadInvoices(entries, tenant.Company, accountLookup)
-		if err != nil {
-			return "Error", err
+	tenantID := r.FormValue("tenant_id")
+	err := updateTenants(func(config *models.TenantConfig) error {
+		for i, tenant := range config.Tenants {
+			if tenant.ID == tenantID {
+				config.Tenants[i].Company = strings.TrimSpace(r.FormValue("company"))
+				config.Tenants[i].Enabled = r.FormValue("enabled") == "on"
+				return nil
+			}
 		}
+		return errUnknownTenant
+	})
+	if errors.Is(err, errUnknownTenant) {
+		http.Error(w, "Unknown tenant", http.StatusNotFound)
+		return
 	}
-	return "Success", nil
+	if errors.Is(err, errInvalidCompany) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusFound)
 }
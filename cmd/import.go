@@ -0,0 +1,341 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/karman-dev-team/xero-transaction-bq-uploader/models"
+	"golang.org/x/oauth2"
+	"golang.org/x/sync/errgroup"
+)
+
+// importWorkers returns how many tenants are imported at once. Xero's rate
+// limits apply per tenant, so tenants can be fetched in parallel freely.
+func importWorkers() (int, error) {
+	workers, err := strconv.Atoi(envOrDefault("IMPORT_WORKERS", "4"))
+	if err != nil || workers < 1 {
+		return 0, fmt.Errorf("IMPORT_WORKERS must be a positive number, got %q", envOrDefault("IMPORT_WORKERS", "4"))
+	}
+	return workers, nil
+}
+
+// importXeroData fetches, converts and uploads the data of every enabled
+// tenant, or of opts.Tenants when it is set. opts.Since re-imports everything
+// changed since that date instead of resuming from the sync state, and
+// opts.DryRun runs the ledger pipeline without writing anything, reporting a
+// preview of its rows instead and writing them to opts.PreviewCSV when it is
+// set; documents are not fetched in a dry run. Tenants are imported in
+// parallel and a failing tenant does not stop the others; cancelling ctx
+// stops them all.
+func importXeroData(ctx context.Context, opts models.ImportOptions, report progressFunc) (string, error) {
+	tokenSource := currentTokenSource()
+	if tokenSource == nil {
+		return "Error", errors.New("not connected to Xero")
+	}
+	workers, err := importWorkers()
+	if err != nil {
+		return "Error", err
+	}
+	config, err := loadTenants()
+	if err != nil {
+		return "Error", err
+	}
+	tenantID, err := enabledTenants(config)
+	if err != nil {
+		return "Error", err
+	}
+	selected, err := selectTenants(tenantID, opts.Tenants)
+	if err != nil {
+		return "Error", err
+	}
+	unlock, err := lockTenants(selected)
+	if err != nil {
+		return "Error", err
+	}
+	defer unlock()
+	ruleSet, err := loadAccountRules(accountRulesPath())
+	if err != nil {
+		return "Error", err
+	}
+	sinks, err := newSinks()
+	if err != nil {
+		return "Error", err
+	}
+	bigQuery := hasBQSink(sinks)
+	if !bigQuery {
+		fmt.Println("No BigQuery sink configured, so documents are not imported and exceptions are only reported in the job events")
+	}
+	checked := make(map[models.BQDestination]bool)
+	for _, tenant := range selected {
+		tables := map[models.BQDestination]bqTableSpec{
+			tenantDestination(tenant):              transactionsTableSpec,
+			tenantTable(tenant, bqExceptionsTable): exceptionsTableSpec,
+		}
+		for _, documents := range documentSyncs {
+			tables[documents.destination(tenant)] = documents.tableSpec()
+		}
+		for destination, spec := range tables {
+			if opts.DryRun || !bigQuery || checked[destination] {
+				continue
+			}
+			diff, err := ensureBQTable(ctx, destination, spec)
+			if description := describeSchemaDiff(diff); description != "" {
+				fmt.Printf("Schema of BigQuery table %s: %s\n", diff.Table, description)
+				report.send(models.JobEvent{Type: "schema", Endpoint: diff.Table, Message: description, Schema: &diff})
+			}
+			if err != nil {
+				return "Error", err
+			}
+			checked[destination] = true
+		}
+	}
+	store, err := loadSyncStore(syncStatePath())
+	if err != nil {
+		return "Error", err
+	}
+	maxUnmapped, err := unmappedThreshold()
+	if err != nil {
+		return "Error", err
+	}
+	runID, err := newJobID()
+	if err != nil {
+		return "Error", err
+	}
+	rates, err := newRateSource()
+	if err != nil {
+		return "Error", err
+	}
+	run := &importRun{
+		opts:        opts,
+		id:          runID,
+		maxUnmapped: maxUnmapped,
+		rules:       ruleSet,
+		tokenSource: tokenSource,
+		store:       store,
+		rates:       rates,
+		sinks:       sinks,
+		bigQuery:    bigQuery,
+	}
+	if opts.DryRun {
+		run.preview, err = newDryRunPreview(opts.PreviewCSV)
+		if err != nil {
+			return "Error", err
+		}
+		defer run.preview.close()
+	}
+
+	var mu sync.Mutex
+	totalRows := 0
+	failures := []error{}
+	tenantGroup := errgroup.Group{}
+	tenantGroup.SetLimit(workers)
+	for _, tenant := range selected {
+		tenant := tenant
+		tenantGroup.Go(func() error {
+			rows, err := importTenant(ctx, run, report.forTenant(tenant.Company), tenant)
+			mu.Lock()
+			defer mu.Unlock()
+			totalRows += rows
+			if err != nil {
+				failures = append(failures, fmt.Errorf("importing %s: %w", tenant.Company, err))
+			}
+			return nil
+		})
+	}
+	tenantGroup.Wait()
+	if len(failures) > 0 {
+		return "Error", errors.Join(failures...)
+	}
+	if opts.DryRun {
+		err = run.preview.close()
+		if err != nil {
+			return "Error", fmt.Errorf("writing dry run CSV: %w", err)
+		}
+		summary := run.preview.summary()
+		report.send(models.JobEvent{Type: "preview", Rows: summary.Rows, Preview: &summary})
+		if opts.PreviewCSV != "" {
+			return fmt.Sprintf("Dry run complete: %d rows would be written, ledger rows saved to %s", totalRows, opts.PreviewCSV), nil
+		}
+		return fmt.Sprintf("Dry run complete: %d rows would be written", totalRows), nil
+	}
+	return "Success", nil
+}
+
+// importRun holds what every tenant of one import shares.
+type importRun struct {
+	opts        models.ImportOptions
+	id          string
+	maxUnmapped int
+	rules       models.AccountRuleSet
+	tokenSource oauth2.TokenSource
+	store       *syncStore
+	rates       rateSource
+	sinks       []sink
+	// bigQuery is set when one of sinks is BigQuery. Documents and the
+	// exceptions report are only written to BigQuery, so they are skipped
+	// without it.
+	bigQuery bool
+	preview  *dryRunPreview
+}
+
+// importTenant imports one tenant and returns the number of rows converted
+// for BigQuery. The ledger and each document endpoint are fetched at the same
+// time and streamed page by page, the ledger to each of run.sinks and the
+// documents to BigQuery, if it is one of them. The sync state only moves
+// forward once all of them have succeeded, and the ledger's only when
+// BigQuery is one of run.sinks. Ledger rows with unmapped account codes are
+// reported under the run's ID, and fail the import when there are more than
+// run.maxUnmapped of them.
+func importTenant(ctx context.Context, run *importRun, report progressFunc, tenant models.XeroCompany) (int, error) {
+	opts, tokenSource, store := run.opts, run.tokenSource, run.store
+	accounts, err := getAccountLookupTable(ctx, tokenSource, tenant.ID)
+	if err != nil {
+		return 0, fmt.Errorf("fetching accounts: %w", err)
+	}
+	// Each tenant is mapped with its own chart of accounts only, and a rule
+	// it cannot apply fails only its own import.
+	mapping, err := modifyAccountLookupTable(accounts, run.rules, tenant.Company)
+	if err != nil {
+		return 0, err
+	}
+	baseCurrency, err := getBaseCurrency(ctx, tokenSource, tenant.ID)
+	if err != nil {
+		return 0, fmt.Errorf("fetching base currency: %w", err)
+	}
+	fx := fxConverter{baseCurrency: baseCurrency, reportingCurrency: reportingCurrency(baseCurrency), rates: run.rates}
+	state := store.get(tenant.ID)
+	from := syncRange{
+		TransactionsSince: state.ModifiedSince[bankTransactionsEndpoint],
+		JournalOffset:     state.LastJournalNumber,
+	}
+	if !opts.Since.IsZero() {
+		from = syncRange{TransactionsSince: opts.Since, JournalsSince: opts.Since}
+	}
+	fullSync := from.full()
+
+	var result pipelineResult
+	documentRows := make([]int, len(documentSyncs))
+	documentsUpdated := make([]time.Time, len(documentSyncs))
+	group, groupCtx := errgroup.WithContext(ctx)
+	group.Go(func() error {
+		var writer rowWriter[models.BQTransaction] = previewWriter{preview: run.preview}
+		if !opts.DryRun {
+			var err error
+			writer, err = openSinks(groupCtx, report, run.sinks, tenant, run.id, fullSync)
+			if err != nil {
+				return err
+			}
+		}
+		var err error
+		result, err = runPipeline(groupCtx, report, tokenSource, tenant, mapping, fx, from, run.maxUnmapped, writer)
+		return err
+	})
+	for i, documents := range documentSyncs {
+		// Documents only go to BigQuery, and a dry run would spend the
+		// tenant's daily quota on rows its preview leaves out.
+		if !run.bigQuery || opts.DryRun {
+			break
+		}
+		i, documents := i, documents
+		since := state.ModifiedSince[documents.endpoint()]
+		if !opts.Since.IsZero() {
+			since = opts.Since
+		}
+		group.Go(func() error {
+			var err error
+			documentRows[i], documentsUpdated[i], err = documents.importSince(groupCtx, report, tokenSource, tenant, since)
+			if errors.Is(err, errTenantDisconnected) {
+				// Tokens saved before an endpoint's scope was added are refused
+				// with a 403. A tenant that really is disconnected fails the
+				// ledger import anyway.
+				fmt.Printf("Skipping %s for %s, reconnect to Xero to grant access: %v\n", documents.endpoint(), tenant.Company, err)
+				report.send(models.JobEvent{Type: "skipped", Endpoint: documents.endpoint(), Message: "access denied, reconnect to Xero to grant access"})
+				return nil
+			}
+			return err
+		})
+	}
+	err = group.Wait()
+	if err != nil {
+		return 0, errors.Join(err, run.reportExceptions(ctx, report, tenant, result))
+	}
+	fmt.Println("Number of entries: ", result.Entries)
+	rows := result.Rows
+	for i := range documentSyncs {
+		rows += documentRows[i]
+	}
+	if opts.DryRun {
+		err = run.reportExceptions(ctx, report, tenant, result)
+		if err != nil {
+			return 0, err
+		}
+		report.send(models.JobEvent{Type: "dry-run", Rows: rows})
+		return rows, nil
+	}
+	if !run.bigQuery {
+		fmt.Println("Skipping reconciliation of bank transactions with journals from earlier runs, which only runs on BigQuery")
+	} else if os.Getenv("BQ_WRITE_MODE") != "append" {
+		documentTables := []models.BQDestination{}
+		for _, documents := range documentSyncs {
+			if documents.hasContact() {
+				documentTables = append(documentTables, documents.destination(tenant))
+			}
+		}
+		// A full sync may have filled in documents for journals of any age.
+		var sourceIDs []string
+		if !fullSync {
+			sourceIDs = []string{}
+			for id := range result.JournalSources {
+				sourceIDs = append(sourceIDs, id)
+			}
+		}
+		err = fillJournalContacts(ctx, tenant.Company, tenantDestination(tenant), documentTables, sourceIDs)
+		if err != nil {
+			return 0, errors.Join(fmt.Errorf("filling journal contacts: %w", err), run.reportExceptions(ctx, report, tenant, result))
+		}
+		err = reconcileBankTransactions(ctx, tenant.Company, tenantDestination(tenant), result.Superseded)
+		if err != nil {
+			return 0, errors.Join(fmt.Errorf("reconciling bank transactions with journals: %w", err), run.reportExceptions(ctx, report, tenant, result))
+		}
+	} else {
+		fmt.Println("Skipping reconciliation of bank transactions with journals from earlier runs, which BQ_WRITE_MODE=append does not support")
+	}
+	err = run.reportExceptions(ctx, report, tenant, result)
+	if err != nil {
+		return 0, err
+	}
+	// The ledger marks are shared by every set of sinks, so they only move
+	// once the rows are in BigQuery. Without it every run is a full sync,
+	// which the file sinks can always take.
+	if run.bigQuery {
+		state.ModifiedSince[bankTransactionsEndpoint] = maxTime(state.ModifiedSince[bankTransactionsEndpoint], result.LatestUpdated)
+		state.LastJournalNumber = max(state.LastJournalNumber, result.LastJournalNumber)
+	}
+	for i, documents := range documentSyncs {
+		state.ModifiedSince[documents.endpoint()] = maxTime(state.ModifiedSince[documents.endpoint()], documentsUpdated[i])
+	}
+	state.LastRun = time.Now()
+	err = store.put(state)
+	if err != nil {
+		return 0, err
+	}
+	return rows, nil
+}
+
+// reportExceptions reports the unmapped and superseded rows of a tenant's
+// pipeline, if it got as far as running.
+func (run *importRun) reportExceptions(ctx context.Context, report progressFunc, tenant models.XeroCompany, result pipelineResult) error {
+	if result.Unmapped == nil {
+		return nil
+	}
+	err := reportExceptions(ctx, !run.opts.DryRun && run.bigQuery, report, run.id, tenant, result)
+	if err != nil {
+		return fmt.Errorf("writing exceptions report: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/karman-dev-team/xero-transaction-bq-uploader/models"
+)
+
+const (
+	jobRunning   = "running"
+	jobSucceeded = "succeeded"
+	jobFailed    = "failed"
+	jobCancelled = "cancelled"
+)
+
+const (
+	// jobRetention is how long a finished job can still be looked up.
+	jobRetention = time.Hour
+	// maxJobEvents is how many of its latest events a job keeps for
+	// subscribers that join late.
+	maxJobEvents = 1000
+)
+
+// progressFunc receives progress events from a running import. A nil
+// progressFunc discards them.
+type progressFunc func(event models.JobEvent)
+
+func (report progressFunc) send(event models.JobEvent) {
+	if report == nil {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	report(event)
+}
+
+// forTenant returns a progressFunc that tags every event with company.
+func (report progressFunc) forTenant(company string) progressFunc {
+	if report == nil {
+		return nil
+	}
+	return func(event models.JobEvent) {
+		event.Tenant = company
+		report.send(event)
+	}
+}
+
+// importJob is an import running in the background. Events are kept so that
+// subscribers joining late see the whole history before live updates.
+type importJob struct {
+	mu          sync.Mutex
+	job         models.Job
+	events      []models.JobEvent
+	subscribers map[chan models.JobEvent]struct{}
+	cancel      context.CancelFunc
+}
+
+var (
+	jobsMu sync.Mutex
+	jobs   = make(map[string]*importJob)
+)
+
+// startImportJob runs run in the background and returns the job tracking it.
+func startImportJob(run func(ctx context.Context, report progressFunc) (string, error)) (*importJob, error) {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	pruneJobs(time.Now())
+	id, err := newJobID()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	job := &importJob{
+		job:         models.Job{ID: id, Status: jobRunning, Started: time.Now()},
+		subscribers: make(map[chan models.JobEvent]struct{}),
+		cancel:      cancel,
+	}
+	jobs[id] = job
+
+	go func() {
+		defer cancel()
+		msg, err := run(ctx, job.publish)
+		job.finish(msg, err, ctx.Err() != nil)
+	}()
+	return job, nil
+}
+
+// pruneJobs forgets jobs that finished more than jobRetention ago. jobsMu
+// must be held.
+func pruneJobs(now time.Time) {
+	for id, job := range jobs {
+		snapshot := job.snapshot()
+		if snapshot.Status != jobRunning && now.Sub(snapshot.Finished) > jobRetention {
+			delete(jobs, id)
+		}
+	}
+}
+
+func getImportJob(id string) (*importJob, bool) {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	job, ok := jobs[id]
+	return job, ok
+}
+
+func newJobID() (string, error) {
+	b := make([]byte, 8)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func (j *importJob) snapshot() models.Job {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.job
+}
+
+func (j *importJob) publish(event models.JobEvent) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.events = append(j.events, event)
+	if len(j.events) > maxJobEvents {
+		j.events = j.events[len(j.events)-maxJobEvents:]
+	}
+	for subscriber := range j.subscribers {
+		select {
+		case subscriber <- event:
+		default:
+			// A subscriber that cannot keep up misses live events rather than
+			// stalling the import.
+		}
+	}
+}
+
+func (j *importJob) finish(msg string, err error, cancelled bool) {
+	status := jobSucceeded
+	if err != nil {
+		status = jobFailed
+		msg = err.Error()
+	}
+	if cancelled {
+		status = jobCancelled
+		msg = "Import cancelled"
+	}
+	j.publish(models.JobEvent{Type: status, Time: time.Now(), Message: msg})
+	j.mu.Lock()
+	j.job.Status = status
+	j.job.Message = msg
+	j.job.Finished = time.Now()
+	for subscriber := range j.subscribers {
+		close(subscriber)
+	}
+	j.subscribers = nil
+	j.mu.Unlock()
+}
+
+// subscribe returns the events published so far and a channel of the events
+// that follow. The channel is closed when the job finishes.
+func (j *importJob) subscribe() ([]models.JobEvent, chan models.JobEvent) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	history := append([]models.JobEvent{}, j.events...)
+	events := make(chan models.JobEvent, 64)
+	if j.subscribers == nil {
+		close(events)
+		return history, events
+	}
+	j.subscribers[events] = struct{}{}
+	return history, events
+}
+
+func (j *importJob) unsubscribe(events chan models.JobEvent) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if _, ok := j.subscribers[events]; ok {
+		delete(j.subscribers, events)
+		close(events)
+	}
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
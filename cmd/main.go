@@ -1,6 +1,9 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"io/fs"
 	"log"
 	"net/http"
 	"os"
@@ -17,22 +20,55 @@ var (
 			AuthURL:  "https://login.xero.com/identity/connect/authorize",
 			TokenURL: "https://identity.xero.com/connect/token",
 		},
-		Scopes: []string{"offline_access accounting.transactions accounting.settings accounting.journals.read"},
+		Scopes: []string{"offline_access accounting.transactions accounting.settings accounting.journals.read accounting.contacts.read"},
 	}
 )
 
 var App models.App
 
+var bqDestination models.BQDestination
+
+// Tables for the Xero documents, in the same dataset as bqDestination.
+var (
+	bqInvoicesTable     string
+	bqCreditNotesTable  string
+	bqPaymentsTable     string
+	bqOverpaymentsTable string
+	bqPrepaymentsTable  string
+	bqContactsTable     string
+	bqTrackingTable     string
+	bqExceptionsTable   string
+)
+
 func main() {
 	err := godotenv.Load()
-	if err != nil {
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
 		log.Fatal("Error loading .env file")
 	}
 	oauth2Config.ClientID = os.Getenv("CLIENT_ID")
 	oauth2Config.ClientSecret = os.Getenv("CLIENT_SECRET")
+	os.Exit(run(os.Args[1:]))
+}
+
+func serve() error {
+	err := startScheduler(context.Background())
+	if err != nil {
+		return err
+	}
 	http.HandleFunc("/", handleHome)
 	http.HandleFunc("/callback", handleCallback)
 	http.HandleFunc("/connect", handleConnect)
 	http.HandleFunc("/import", handleImport)
-	http.ListenAndServe(":8080", nil)
+	http.HandleFunc("/tenants", handleTenants)
+	http.HandleFunc("/jobs/", handleJobs)
+	http.HandleFunc("/previews/", handlePreviews)
+	return http.ListenAndServe(":8080", nil)
+}
+
+func envOrDefault(key string, defaultValue string) string {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	return value
 }
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/apache/arrow/go/v12/arrow"
+	"github.com/apache/arrow/go/v12/arrow/array"
+	"github.com/apache/arrow/go/v12/arrow/memory"
+	"github.com/apache/arrow/go/v12/parquet"
+	"github.com/apache/arrow/go/v12/parquet/compress"
+	"github.com/apache/arrow/go/v12/parquet/pqarrow"
+)
+
+// parquetEncoder writes rows to a Snappy compressed Parquet file whose
+// columns follow the BigQuery schema, with records as structs and repeated
+// columns as lists. Every batch is written out as its own row group, so an
+// open file holds no rows in memory, however many months a writer has open.
+type parquetEncoder struct {
+	schema  bigquery.Schema
+	builder *array.RecordBuilder
+	writer  *pqarrow.FileWriter
+}
+
+func newParquetEncoder(w io.Writer, schema bigquery.Schema) (rowEncoder, error) {
+	fields, err := arrowFields(schema)
+	if err != nil {
+		return nil, err
+	}
+	arrowSchema := arrow.NewSchema(fields, nil)
+	props := parquet.NewWriterProperties(parquet.WithCompression(compress.Codecs.Snappy))
+	// The Parquet writer closes writers that are io.Closers, which is left
+	// to the caller.
+	writer, err := pqarrow.NewFileWriter(arrowSchema, struct{ io.Writer }{w}, props, pqarrow.NewArrowWriterProperties(pqarrow.WithStoreSchema()))
+	if err != nil {
+		return nil, err
+	}
+	return &parquetEncoder{
+		schema:  schema,
+		builder: array.NewRecordBuilder(memory.DefaultAllocator, arrowSchema),
+		writer:  writer,
+	}, nil
+}
+
+func (e *parquetEncoder) encode(rows []map[string]bigquery.Value) error {
+	for _, values := range rows {
+		for i, field := range e.schema {
+			err := appendArrowValue(e.builder.Field(i), field, values[field.Name])
+			if err != nil {
+				return err
+			}
+		}
+	}
+	record := e.builder.NewRecord()
+	defer record.Release()
+	return e.writer.Write(record)
+}
+
+func (e *parquetEncoder) close() error {
+	e.builder.Release()
+	return e.writer.Close()
+}
+
+func arrowFields(schema bigquery.Schema) ([]arrow.Field, error) {
+	fields := []arrow.Field{}
+	for _, field := range schema {
+		dataType, err := arrowType(field)
+		if err != nil {
+			return nil, err
+		}
+		if field.Repeated {
+			dataType = arrow.ListOf(dataType)
+		}
+		fields = append(fields, arrow.Field{Name: field.Name, Type: dataType, Nullable: !field.Required && !field.Repeated})
+	}
+	return fields, nil
+}
+
+func arrowType(field *bigquery.FieldSchema) (arrow.DataType, error) {
+	switch field.Type {
+	case bigquery.StringFieldType:
+		return arrow.BinaryTypes.String, nil
+	case bigquery.IntegerFieldType:
+		return arrow.PrimitiveTypes.Int64, nil
+	case bigquery.FloatFieldType:
+		return arrow.PrimitiveTypes.Float64, nil
+	case bigquery.BooleanFieldType:
+		return arrow.FixedWidthTypes.Boolean, nil
+	case bigquery.TimestampFieldType:
+		return &arrow.TimestampType{Unit: arrow.Microsecond, TimeZone: "UTC"}, nil
+	case bigquery.RecordFieldType:
+		fields, err := arrowFields(field.Schema)
+		if err != nil {
+			return nil, err
+		}
+		return arrow.StructOf(fields...), nil
+	}
+	return nil, fmt.Errorf("column %s: %s columns cannot be written to Parquet", field.Name, field.Type)
+}
+
+func appendArrowValue(builder array.Builder, field *bigquery.FieldSchema, value bigquery.Value) error {
+	if field.Repeated {
+		list := builder.(*array.ListBuilder)
+		list.Append(true)
+		values, _ := value.([]bigquery.Value)
+		element := *field
+		element.Repeated = false
+		for _, value := range values {
+			err := appendArrowValue(list.ValueBuilder(), &element, value)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if value == nil {
+		builder.AppendNull()
+		return nil
+	}
+	switch builder := builder.(type) {
+	case *array.StringBuilder:
+		if value, ok := value.(string); ok {
+			builder.Append(value)
+			return nil
+		}
+	case *array.Int64Builder:
+		if value, ok := value.(int64); ok {
+			builder.Append(value)
+			return nil
+		}
+	case *array.Float64Builder:
+		if value, ok := value.(float64); ok {
+			builder.Append(value)
+			return nil
+		}
+	case *array.BooleanBuilder:
+		if value, ok := value.(bool); ok {
+			builder.Append(value)
+			return nil
+		}
+	case *array.TimestampBuilder:
+		if value, ok := value.(time.Time); ok {
+			builder.Append(arrow.Timestamp(value.UnixMicro()))
+			return nil
+		}
+	case *array.StructBuilder:
+		if values, ok := value.(map[string]bigquery.Value); ok {
+			builder.Append(true)
+			for i, subfield := range field.Schema {
+				err := appendArrowValue(builder.FieldBuilder(i), subfield, values[subfield.Name])
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("column %s: cannot write %T to Parquet", field.Name, value)
+}
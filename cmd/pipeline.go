@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/karman-dev-team/xero-transaction-bq-uploader/models"
+	"golang.org/x/oauth2"
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	// pipelineBatchSize is how many rows are handed to a writer at once.
+	pipelineBatchSize = 1000
+	// pipelineBuffer is how many converted pages may wait for the writer
+	// before fetching pauses.
+	pipelineBuffer = 4
+)
+
+// syncRange is where a tenant import starts from.
+type syncRange struct {
+	TransactionsSince time.Time
+	JournalOffset     int
+	JournalsSince     time.Time
+}
+
+// full reports whether the range covers everything Xero has.
+func (r syncRange) full() bool {
+	return r.TransactionsSince.IsZero() && r.JournalOffset == 0 && r.JournalsSince.IsZero()
+}
+
+// pipelineResult summarises a finished pipeline run.
+type pipelineResult struct {
+	Entries           int
+	Rows              int
+	LatestUpdated     time.Time
+	LastJournalNumber int
+	Unmapped          *unmappedAccounts
+	Superseded        *supersededRows
+	MissingRates      *missingRates
+	// JournalSources holds the source IDs of the journal rows written
+	// without a contact, for fillJournalContacts. It is nil for a full sync,
+	// which fills in the contacts of every row.
+	JournalSources map[string]bool
+}
+
+// pipelinePage is a fetched page of either endpoint, or the mark that every
+// journal has been sent.
+type pipelinePage struct {
+	entries      []models.AccountTransaction
+	journalsDone bool
+}
+
+// runPipeline streams a tenant's bank transactions and journals through
+// fetch, convert, batch and write. Both endpoints are fetched at the same
+// time; each page is converted as soon as it is fetched and at most
+// pipelineBuffer pages wait for the writer, so the rows themselves are never
+// all held in memory. Bank transaction rows duplicating a journal line are
+// flagged superseded before any writer sees them, which takes memory growing
+// with the ledger: the reconciler keeps the key of every journal line of a
+// bank transaction, and holds back the bank transaction rows fetched before
+// their journal. The writer is always
+// closed; if anything fails its rows are discarded. Having more than
+// maxUnmapped rows with unmapped account codes is a failure too, unless
+// maxUnmapped is -1. It is checked before every write, as writers in
+// BQ_WRITE_MODE=append keep the batches written before a failure.
+func runPipeline(ctx context.Context, report progressFunc, tokenSource oauth2.TokenSource, tenant models.XeroCompany, mapping accountMapping, fx fxConverter, from syncRange, maxUnmapped int, writer rowWriter[models.BQTransaction]) (pipelineResult, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	result := pipelineResult{
+		LatestUpdated:     from.TransactionsSince,
+		LastJournalNumber: from.JournalOffset,
+		Unmapped:          newUnmappedAccounts(),
+		MissingRates:      newMissingRates(),
+	}
+	if !from.full() {
+		result.JournalSources = make(map[string]bool)
+	}
+	reconciler := newBankReconciler()
+	result.Superseded = reconciler.superseded
+	excluded := excludedAccountCodes(tenant)
+	pages := make(chan pipelinePage, pipelineBuffer)
+	fetch, fetchCtx := errgroup.WithContext(ctx)
+	send := func(page pipelinePage) error {
+		select {
+		case pages <- page:
+			return nil
+		case <-fetchCtx.Done():
+			return fetchCtx.Err()
+		}
+	}
+	fetch.Go(func() error {
+		return getAllTransactions(fetchCtx, report, tokenSource, tenant.ID, from.TransactionsSince, func(page []models.XeroTransaction) error {
+			entries, err := convertTransactionsToAccountTransactions(page)
+			if err != nil {
+				return err
+			}
+			entries, err = filterBankAccountTransactions(entries, excluded)
+			if err != nil {
+				return err
+			}
+			result.LatestUpdated, err = latestUpdatedDate(page, result.LatestUpdated)
+			if err != nil {
+				return err
+			}
+			return send(pipelinePage{entries: entries})
+		})
+	})
+	fetch.Go(func() error {
+		err := getAllJournals(fetchCtx, report, tokenSource, tenant.ID, from.JournalOffset, from.JournalsSince, func(page []models.Journal) error {
+			entries, err := convertJournalsToAccountTransactions(page)
+			if err != nil {
+				return err
+			}
+			result.LastJournalNumber = latestJournalNumber(page, result.LastJournalNumber)
+			return send(pipelinePage{entries: entries})
+		})
+		if err != nil {
+			return err
+		}
+		return send(pipelinePage{journalsDone: true})
+	})
+	var fetchErr error
+	go func() {
+		fetchErr = fetch.Wait()
+		close(pages)
+	}()
+
+	var writeErr error
+	batch := make([]models.BQTransaction, 0, pipelineBatchSize)
+	for page := range pages {
+		if writeErr != nil {
+			// Drain the channel so the fetchers can see the cancellation.
+			continue
+		}
+		var rows []models.BQTransaction
+		if page.journalsDone {
+			rows = reconciler.finishJournals()
+		} else {
+			result.Entries += len(page.entries)
+			converted, err := convertToBQInvoice(page.entries, tenant.Company, mapping, fx, result.Unmapped, result.MissingRates)
+			if err != nil {
+				writeErr = err
+				cancel()
+				continue
+			}
+			rows = reconciler.apply(converted)
+		}
+		for _, row := range rows {
+			if result.JournalSources != nil && row.Origin == journalsEndpoint && row.ContactID == "" && row.SourceID != "" {
+				result.JournalSources[row.SourceID] = true
+			}
+			batch = append(batch, row)
+			if len(batch) < pipelineBatchSize {
+				continue
+			}
+			writeErr = checkUnmapped(result.Unmapped, maxUnmapped)
+			if writeErr == nil {
+				writeErr = writer.Write(ctx, batch)
+			}
+			result.Rows += len(batch)
+			batch = make([]models.BQTransaction, 0, pipelineBatchSize)
+			if writeErr != nil {
+				cancel()
+				break
+			}
+		}
+	}
+	if writeErr == nil && fetchErr == nil {
+		writeErr = checkUnmapped(result.Unmapped, maxUnmapped)
+	}
+	if writeErr == nil && fetchErr == nil && len(batch) > 0 {
+		writeErr = writer.Write(ctx, batch)
+		result.Rows += len(batch)
+	}
+	if writeErr != nil || fetchErr != nil {
+		cancel()
+	}
+	report.send(models.JobEvent{Type: "entries", Rows: result.Entries})
+	closeErr := writer.Close(ctx)
+	if writeErr != nil {
+		return result, writeErr
+	}
+	if fetchErr != nil {
+		return result, fetchErr
+	}
+	return result, closeErr
+}
+
+func checkUnmapped(unmapped *unmappedAccounts, maxUnmapped int) error {
+	if maxUnmapped >= 0 && unmapped.rows > maxUnmapped {
+		return fmt.Errorf("%d rows have unmapped account codes, more than UNMAPPED_ROWS_THRESHOLD allows (%d)", unmapped.rows, maxUnmapped)
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/karman-dev-team/xero-transaction-bq-uploader/models"
+)
+
+// previewSampleSize is how many rows a dry run keeps to show.
+const previewSampleSize = 20
+
+type previewKey struct {
+	company, group, revenueLine string
+}
+
+// dryRunPreview collects what a dry run would have written to the
+// transactions table: row counts and amounts per company, group and revenue
+// line, the first rows as a sample and, when it has a CSV file, every row.
+// The counts and sample leave out deleted and superseded rows, as totals
+// built on the table do. It is shared by the tenants of a run.
+type dryRunPreview struct {
+	mu     sync.Mutex
+	groups map[previewKey]*models.PreviewGroup
+	sample []models.BQTransaction
+	rows   int
+	schema bigquery.Schema
+	file   *os.File
+	csv    rowEncoder
+}
+
+// previewRetention is how long the CSV of a dry run started from the web UI
+// is kept.
+const previewRetention = 24 * time.Hour
+
+func previewDir() string {
+	return envOrDefault("PREVIEW_DIR", os.TempDir())
+}
+
+// previewCSVPath returns where the CSV of the dry run with the given ID is
+// written, in PREVIEW_DIR or the temporary directory.
+func previewCSVPath(id string) string {
+	return filepath.Join(previewDir(), fmt.Sprintf("dry-run-%s.csv", id))
+}
+
+// removeOldPreviews deletes the dry run CSVs older than previewRetention.
+func removeOldPreviews(now time.Time) {
+	paths, err := filepath.Glob(filepath.Join(previewDir(), "dry-run-*.csv"))
+	if err != nil {
+		return
+	}
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil || now.Sub(info.ModTime()) < previewRetention {
+			continue
+		}
+		err = os.Remove(path)
+		if err != nil {
+			fmt.Printf("Failed to remove old dry run CSV %s: %v\n", path, err)
+		}
+	}
+}
+
+func newDryRunPreview(csvPath string) (*dryRunPreview, error) {
+	schema, err := bigquery.InferSchema(models.BQTransaction{})
+	if err != nil {
+		return nil, err
+	}
+	preview := &dryRunPreview{
+		groups: make(map[previewKey]*models.PreviewGroup),
+		schema: schema,
+	}
+	if csvPath == "" {
+		return preview, nil
+	}
+	preview.file, err = os.Create(csvPath)
+	if err != nil {
+		return nil, fmt.Errorf("creating dry run CSV: %w", err)
+	}
+	preview.csv, err = newCSVEncoder(preview.file, schema)
+	if err != nil {
+		preview.file.Close()
+		return nil, err
+	}
+	return preview, nil
+}
+
+func (p *dryRunPreview) add(rows []models.BQTransaction) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, row := range rows {
+		p.rows++
+		if !row.Deleted && !row.Superseded {
+			p.count(row)
+		}
+		if p.csv != nil {
+			values, err := saveRow(row, p.schema)
+			if err != nil {
+				return err
+			}
+			err = p.csv.encode([]map[string]bigquery.Value{values})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// count adds a row that the warehouse's totals include to its group and the
+// sample. Amounts are signed and in the reporting currency; rows without an
+// FX rate are counted but add nothing.
+func (p *dryRunPreview) count(row models.BQTransaction) {
+	key := previewKey{company: row.Company, group: row.Group, revenueLine: row.RevenueLine}
+	group, ok := p.groups[key]
+	if !ok {
+		group = &models.PreviewGroup{Company: row.Company, Group: row.Group, RevenueLine: row.RevenueLine, Currency: row.ReportingCurrency}
+		p.groups[key] = group
+	}
+	group.Rows++
+	group.Amount += row.ReportingAmount.Float64
+	if len(p.sample) < previewSampleSize {
+		p.sample = append(p.sample, row)
+	}
+}
+
+// summary returns the counts, largest groups first, and the sample rows.
+func (p *dryRunPreview) summary() models.DryRunPreview {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	groups := []models.PreviewGroup{}
+	for _, group := range p.groups {
+		groups = append(groups, *group)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		if groups[i].Company != groups[j].Company {
+			return groups[i].Company < groups[j].Company
+		}
+		if groups[i].Group != groups[j].Group {
+			return groups[i].Group < groups[j].Group
+		}
+		return groups[i].RevenueLine < groups[j].RevenueLine
+	})
+	return models.DryRunPreview{Rows: p.rows, Groups: groups, Sample: p.sample}
+}
+
+// close flushes and closes the CSV file. It may be called more than once.
+func (p *dryRunPreview) close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.csv == nil {
+		return nil
+	}
+	err := p.csv.close()
+	closeErr := p.file.Close()
+	p.csv, p.file = nil, nil
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+// previewWriter adds a tenant's rows to the preview instead of writing them.
+type previewWriter struct {
+	preview *dryRunPreview
+}
+
+func (w previewWriter) Write(ctx context.Context, rows []models.BQTransaction) error {
+	return w.preview.add(rows)
+}
+
+func (w previewWriter) Close(ctx context.Context) error {
+	return nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Xero allows each tenant 60 calls a minute, 5 calls in flight and a daily
+// quota. https://developer.xero.com/documentation/guides/oauth2/limits/
+const (
+	xeroCallsPerMinute   = 60
+	xeroConcurrentCalls  = 5
+	xeroMaxRetryAfter    = 5 * time.Minute
+	xeroDayLimitLogBelow = 500
+)
+
+// rateLimiter paces the calls made to one Xero tenant. It counts calls in a
+// sliding one minute window and also honours what Xero reports back in the
+// X-MinLimit-Remaining, X-DayLimit-Remaining and Retry-After headers.
+type rateLimiter struct {
+	mu           sync.Mutex
+	inFlight     chan struct{}
+	calls        []time.Time
+	blockedUntil time.Time
+}
+
+var (
+	rateLimitersMu sync.Mutex
+	rateLimiters   = make(map[string]*rateLimiter)
+)
+
+func tenantRateLimiter(tenantID string) *rateLimiter {
+	rateLimitersMu.Lock()
+	defer rateLimitersMu.Unlock()
+	limiter, ok := rateLimiters[tenantID]
+	if !ok {
+		limiter = &rateLimiter{
+			inFlight: make(chan struct{}, xeroConcurrentCalls),
+		}
+		rateLimiters[tenantID] = limiter
+	}
+	return limiter
+}
+
+// acquire blocks until a call may be made and returns a function that must be
+// called once the response has been read. If Xero has blocked the tenant for
+// longer than xeroMaxRetryAfter, as it does once the daily quota is used up,
+// it fails straight away instead.
+func (l *rateLimiter) acquire(ctx context.Context) (func(), error) {
+	select {
+	case l.inFlight <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	release := func() { <-l.inFlight }
+	for {
+		wait := l.reserve(time.Now())
+		if wait <= 0 {
+			return release, nil
+		}
+		if wait > xeroMaxRetryAfter {
+			release()
+			return nil, fmt.Errorf("Xero has blocked calls until %s", time.Now().Add(wait).Format(time.RFC3339))
+		}
+		err := sleepContext(ctx, wait)
+		if err != nil {
+			release()
+			return nil, err
+		}
+	}
+}
+
+// reserve records a call at now if the limits allow one, otherwise it returns
+// how long to wait before trying again.
+func (l *rateLimiter) reserve(now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Before(l.blockedUntil) {
+		return l.blockedUntil.Sub(now)
+	}
+	windowStart := now.Add(-time.Minute)
+	for len(l.calls) > 0 && !l.calls[0].After(windowStart) {
+		l.calls = l.calls[1:]
+	}
+	if len(l.calls) >= xeroCallsPerMinute {
+		return l.calls[0].Add(time.Minute).Sub(now)
+	}
+	l.calls = append(l.calls, now)
+	return 0
+}
+
+// blockedFor returns how long Xero has asked us to stop calling for.
+func (l *rateLimiter) blockedFor() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return time.Until(l.blockedUntil)
+}
+
+// observe updates the limiter from the rate limit headers of a response.
+func (l *rateLimiter) observe(resp *http.Response, tenantID string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if remaining, err := strconv.Atoi(resp.Header.Get("X-MinLimit-Remaining")); err == nil && remaining <= 0 {
+		// Xero does not say when the window resets, so wait for the oldest
+		// call we know of to leave it, or a full minute if we know of none.
+		until := now.Add(time.Minute)
+		if len(l.calls) > 0 {
+			until = l.calls[0].Add(time.Minute)
+		}
+		l.blockedUntil = maxTime(l.blockedUntil, until)
+	}
+	if remaining, err := strconv.Atoi(resp.Header.Get("X-DayLimit-Remaining")); err == nil {
+		if remaining < xeroDayLimitLogBelow {
+			fmt.Printf("Xero daily limit for tenant %s is running low: %d calls left\n", tenantID, remaining)
+		}
+	}
+	if resp.StatusCode == http.StatusTooManyRequests {
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+			l.blockedUntil = maxTime(l.blockedUntil, now.Add(time.Duration(seconds)*time.Second))
+		}
+	}
+}
+
+func maxTime(a time.Time, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/karman-dev-team/xero-transaction-bq-uploader/models"
+	"google.golang.org/api/iterator"
+)
+
+// Bank transaction rows are removed from totals by flagging them superseded
+// rather than deleted, which means deleted in Xero. Xero writes a journal for
+// every bank transaction, with the transaction as its SourceID, so a bank
+// transaction line is the same economic event as the journal line for the
+// same source and account. Journals are the canonical rows: each duplicate
+// bank transaction row points at the journal line it duplicates in
+// duplicate_of.
+
+type reconcileKey struct {
+	sourceID, accountCode string
+}
+
+// bankReconciler flags the bank transaction rows of an import that duplicate
+// one of its journal lines. Journals and bank transactions are fetched at the
+// same time, so until every journal has been seen, bank transaction rows
+// without a journal line yet are held back rather than written unflagged.
+type bankReconciler struct {
+	journals     map[reconcileKey]string
+	pending      map[reconcileKey][]models.BQTransaction
+	journalsDone bool
+	superseded   *supersededRows
+}
+
+func newBankReconciler() *bankReconciler {
+	return &bankReconciler{
+		journals:   make(map[reconcileKey]string),
+		pending:    make(map[reconcileKey][]models.BQTransaction),
+		superseded: newSupersededRows(),
+	}
+}
+
+// apply flags the rows that duplicate a journal line seen so far and returns
+// the rows that can be written now, which may include rows held back from
+// earlier calls.
+func (r *bankReconciler) apply(rows []models.BQTransaction) []models.BQTransaction {
+	ready := make([]models.BQTransaction, 0, len(rows))
+	for _, row := range rows {
+		if row.Deleted || (row.SourceType != bankTransactionTypeReceive && row.SourceType != bankTransactionTypeSpend) {
+			ready = append(ready, row)
+			continue
+		}
+		key := reconcileKey{sourceID: row.SourceID, accountCode: row.AccountCode}
+		switch row.Origin {
+		case journalsEndpoint:
+			if _, ok := r.journals[key]; !ok {
+				r.journals[key] = row.TransactionID
+			}
+			ready = append(ready, row)
+			for _, held := range r.pending[key] {
+				ready = append(ready, r.supersede(held, r.journals[key]))
+			}
+			delete(r.pending, key)
+		case bankTransactionsEndpoint:
+			if journalID, ok := r.journals[key]; ok {
+				ready = append(ready, r.supersede(row, journalID))
+			} else if r.journalsDone {
+				ready = append(ready, row)
+			} else {
+				r.pending[key] = append(r.pending[key], row)
+			}
+		default:
+			ready = append(ready, row)
+		}
+	}
+	return ready
+}
+
+// finishJournals is called once every journal has been seen, and returns the
+// held back rows, which duplicate none of them.
+func (r *bankReconciler) finishJournals() []models.BQTransaction {
+	r.journalsDone = true
+	rows := []models.BQTransaction{}
+	for _, held := range r.pending {
+		rows = append(rows, held...)
+	}
+	r.pending = make(map[reconcileKey][]models.BQTransaction)
+	return rows
+}
+
+func (r *bankReconciler) supersede(row models.BQTransaction, journalID string) models.BQTransaction {
+	row.Superseded = true
+	row.DuplicateOf = journalID
+	r.superseded.add(row.AccountCode, row.TransactionID, row.GrossAmount)
+	return row
+}
+
+// supersededRows lists the bank transaction rows removed as duplicates, by
+// account code.
+type supersededRows struct {
+	byCode map[string]*models.BQException
+	rows   int
+}
+
+func newSupersededRows() *supersededRows {
+	return &supersededRows{byCode: make(map[string]*models.BQException)}
+}
+
+func (s *supersededRows) add(accountCode string, id string, amount float64) {
+	exception, ok := s.byCode[accountCode]
+	if !ok {
+		exception = &models.BQException{Kind: exceptionSuperseded, AccountCode: accountCode}
+		s.byCode[accountCode] = exception
+	}
+	exception.Rows++
+	exception.Amount += amount
+	if len(exception.RowIDs) < maxExceptionRowIDs {
+		exception.RowIDs = append(exception.RowIDs, id)
+	}
+	s.rows++
+}
+
+// list returns the removed rows per account code, ordered by code.
+func (s *supersededRows) list() []models.BQException {
+	exceptions := []models.BQException{}
+	for _, exception := range s.byCode {
+		exceptions = append(exceptions, *exception)
+	}
+	sort.Slice(exceptions, func(i, j int) bool {
+		return exceptions[i].AccountCode < exceptions[j].AccountCode
+	})
+	return exceptions
+}
+
+type reconcileMatch struct {
+	ID          string  `bigquery:"id"`
+	DuplicateOf string  `bigquery:"duplicate_of"`
+	AccountCode string  `bigquery:"account_code"`
+	GrossAmount float64 `bigquery:"gross_amount"`
+}
+
+// reconcileBankTransactions flags the bank transaction rows in BigQuery that
+// duplicate a journal line imported by an earlier run, which the import's
+// own reconciliation cannot see, and adds them to superseded. A MERGE of the
+// bank transaction resets the flag, so it has to run after every import.
+func reconcileBankTransactions(ctx context.Context, company string, destination models.BQDestination, superseded *supersededRows) error {
+	client, err := bigquery.NewClient(ctx, destination.ProjectID)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	defer lockTable(destination)()
+	query := client.Query(buildReconcileQuery(destination))
+	query.Parameters = []bigquery.QueryParameter{{Name: "company", Value: company}}
+	it, err := query.Read(ctx)
+	if err != nil {
+		return err
+	}
+	matches := []reconcileMatch{}
+	for {
+		var match reconcileMatch
+		err := it.Next(&match)
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		matches = append(matches, match)
+	}
+	if len(matches) == 0 {
+		return nil
+	}
+	query = client.Query(buildSupersedeQuery(destination))
+	query.Parameters = []bigquery.QueryParameter{
+		{Name: "company", Value: company},
+		{Name: "matches", Value: matches},
+	}
+	job, err := query.Run(ctx)
+	if err != nil {
+		return err
+	}
+	status, err := job.Wait(ctx)
+	if err != nil {
+		return err
+	}
+	if err := status.Err(); err != nil {
+		return err
+	}
+	for _, match := range matches {
+		superseded.add(match.AccountCode, match.ID, match.GrossAmount)
+	}
+	return nil
+}
+
+// buildReconcileQuery selects the live bank transaction rows that duplicate a
+// journal line and are not flagged yet.
+func buildReconcileQuery(destination models.BQDestination) string {
+	table := fmt.Sprintf("`%s.%s.%s`", destination.ProjectID, destination.DatasetID, destination.TableID)
+	query := "SELECT B.id, J.id AS duplicate_of, B.account_code, B.gross_amount\n"
+	query += fmt.Sprintf("FROM %s B\n", table)
+	query += fmt.Sprintf("JOIN (SELECT source_id, account_code, ANY_VALUE(id) AS id FROM %s WHERE company = @company AND origin = '%s' AND source_type IN ('%s', '%s') AND NOT IFNULL(deleted, FALSE) GROUP BY source_id, account_code) J\n", table, journalsEndpoint, bankTransactionTypeReceive, bankTransactionTypeSpend)
+	query += "ON B.source_id = J.source_id AND IFNULL(B.account_code, '') = IFNULL(J.account_code, '')\n"
+	query += fmt.Sprintf("WHERE B.company = @company AND B.origin = '%s' AND NOT IFNULL(B.superseded, FALSE) AND NOT IFNULL(B.deleted, FALSE)\n", bankTransactionsEndpoint)
+	return query
+}
+
+func buildSupersedeQuery(destination models.BQDestination) string {
+	query := fmt.Sprintf("UPDATE `%s.%s.%s` T SET superseded = TRUE, duplicate_of = M.duplicate_of\n", destination.ProjectID, destination.DatasetID, destination.TableID)
+	query += "FROM UNNEST(@matches) M\n"
+	query += "WHERE T.company = @company AND T.id = M.id\n"
+	return query
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/karman-dev-team/xero-transaction-bq-uploader/models"
+)
+
+func journalRow(id, sourceID, accountCode string) models.BQTransaction {
+	return models.BQTransaction{TransactionID: id, SourceID: sourceID, AccountCode: accountCode, SourceType: bankTransactionTypeReceive, Origin: journalsEndpoint, GrossAmount: -10}
+}
+
+func bankRow(id, sourceID, accountCode string) models.BQTransaction {
+	return models.BQTransaction{TransactionID: id, SourceID: sourceID, AccountCode: accountCode, SourceType: bankTransactionTypeReceive, Origin: bankTransactionsEndpoint, GrossAmount: -10}
+}
+
+func TestBankReconciler(t *testing.T) {
+	deleted := bankRow("b-deleted", "s1", "200")
+	deleted.Deleted = true
+	invoiceJournal := journalRow("j-invoice", "s1", "200")
+	invoiceJournal.SourceType = "ACCREC"
+
+	// Each step is a batch of rows, or nil for the end of the journals. want
+	// lists the rows each step returns, as id or id>duplicate_of when they
+	// are superseded.
+	tests := []struct {
+		name  string
+		steps [][]models.BQTransaction
+		want  [][]string
+	}{
+		{
+			name:  "journal first",
+			steps: [][]models.BQTransaction{{journalRow("j1", "s1", "200")}, {bankRow("b1", "s1", "200")}, nil},
+			want:  [][]string{{"j1"}, {"b1>j1"}, {}},
+		},
+		{
+			name:  "bank first",
+			steps: [][]models.BQTransaction{{bankRow("b1", "s1", "200")}, {journalRow("j1", "s1", "200")}, nil},
+			want:  [][]string{{}, {"b1>j1", "j1"}, {}},
+		},
+		{
+			name:  "same batch",
+			steps: [][]models.BQTransaction{{bankRow("b1", "s1", "200"), journalRow("j1", "s1", "200"), bankRow("b2", "s1", "200")}, nil},
+			want:  [][]string{{"b1>j1", "b2>j1", "j1"}, {}},
+		},
+		{
+			name:  "first journal line wins",
+			steps: [][]models.BQTransaction{{journalRow("j1", "s1", "200"), journalRow("j2", "s1", "200"), bankRow("b1", "s1", "200")}, nil},
+			want:  [][]string{{"b1>j1", "j1", "j2"}, {}},
+		},
+		{
+			name:  "no journal",
+			steps: [][]models.BQTransaction{{bankRow("b1", "s1", "200")}, {journalRow("j1", "s2", "200"), journalRow("j2", "s1", "300")}, nil},
+			want:  [][]string{{}, {"j1", "j2"}, {"b1"}},
+		},
+		{
+			name:  "after the journals",
+			steps: [][]models.BQTransaction{{journalRow("j1", "s1", "200")}, nil, {bankRow("b1", "s1", "200"), bankRow("b2", "s2", "200")}},
+			want:  [][]string{{"j1"}, {}, {"b1>j1", "b2"}},
+		},
+		{
+			name:  "deleted and other rows pass",
+			steps: [][]models.BQTransaction{{deleted, invoiceJournal}, {bankRow("b1", "s1", "200")}, nil},
+			want:  [][]string{{"b-deleted", "j-invoice"}, {}, {"b1"}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reconciler := newBankReconciler()
+			for i, step := range test.steps {
+				var rows []models.BQTransaction
+				if step == nil {
+					rows = reconciler.finishJournals()
+				} else {
+					rows = reconciler.apply(step)
+				}
+				got := []string{}
+				for _, row := range rows {
+					if row.Superseded {
+						got = append(got, row.TransactionID+">"+row.DuplicateOf)
+					} else {
+						got = append(got, row.TransactionID)
+					}
+				}
+				sort.Strings(got)
+				if fmt.Sprint(got) != fmt.Sprint(test.want[i]) {
+					t.Errorf("step %d returned %v, want %v", i, got, test.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestSupersededRows(t *testing.T) {
+	superseded := newSupersededRows()
+	for i := 0; i < maxExceptionRowIDs+10; i++ {
+		superseded.add("200", fmt.Sprintf("b%d", i), -1)
+	}
+	superseded.add("100", "a", 5)
+	list := superseded.list()
+	if superseded.rows != maxExceptionRowIDs+11 || len(list) != 2 {
+		t.Fatalf("rows = %d, list = %d codes", superseded.rows, len(list))
+	}
+	if list[0].AccountCode != "100" || list[0].Rows != 1 || list[0].Amount != 5 || list[0].Kind != exceptionSuperseded {
+		t.Errorf("first = %+v", list[0])
+	}
+	if list[1].Rows != maxExceptionRowIDs+10 || len(list[1].RowIDs) != maxExceptionRowIDs || list[1].Amount != -float64(maxExceptionRowIDs+10) {
+		t.Errorf("second has %d rows, %d IDs, amount %v", list[1].Rows, len(list[1].RowIDs), list[1].Amount)
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/karman-dev-team/xero-transaction-bq-uploader/models"
+)
+
+const (
+	ruleActionRemap  = "remap"
+	ruleActionDelete = "delete"
+	ruleScopeAll     = "*"
+)
+
+var ruleColumns = []string{"scope", "action", "source_code", "target_code", "effective_from", "effective_to"}
+
+// accountMapping resolves account codes to their reporting line for a single
+// company, applying the remapping rules in force on the transaction date.
+type accountMapping struct {
+	accounts map[string]models.AccountLookup
+	rules    []models.AccountRule
+}
+
+func accountRulesPath() string {
+	return envOrDefault("ACCOUNT_RULES_FILE", "account_rules.csv")
+}
+
+// loadAccountRules reads the remapping rules file. The file is a CSV with the
+// columns in ruleColumns, preceded by a "# version: <version>" line. Dates are
+// YYYY-MM-DD; effective_to is exclusive and either date may be left empty.
+func loadAccountRules(path string) (models.AccountRuleSet, error) {
+	ruleSet := models.AccountRuleSet{}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ruleSet, fmt.Errorf("reading account rules: %w", err)
+	}
+	firstLine, _, _ := bufio.NewReader(bytes.NewReader(data)).ReadLine()
+	version, ok := strings.CutPrefix(strings.TrimSpace(string(firstLine)), "# version:")
+	if !ok || strings.TrimSpace(version) == "" {
+		return ruleSet, fmt.Errorf("%s: first line must be \"# version: <version>\"", path)
+	}
+	ruleSet.Version = strings.TrimSpace(version)
+
+	reader := csv.NewReader(bytes.NewReader(data))
+	reader.Comment = '#'
+	reader.FieldsPerRecord = len(ruleColumns)
+	header, err := reader.Read()
+	if err != nil {
+		return ruleSet, fmt.Errorf("%s: %w", path, err)
+	}
+	for i, column := range ruleColumns {
+		if strings.TrimSpace(header[i]) != column {
+			return ruleSet, fmt.Errorf("%s: expected column %d to be %q, got %q", path, i+1, column, header[i])
+		}
+	}
+	for {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return ruleSet, fmt.Errorf("%s: %w", path, err)
+		}
+		line, _ := reader.FieldPos(0)
+		rule, err := parseAccountRule(record, line)
+		if err != nil {
+			return ruleSet, fmt.Errorf("%s line %d: %w", path, line, err)
+		}
+		ruleSet.Rules = append(ruleSet.Rules, rule)
+	}
+	return ruleSet, nil
+}
+
+func parseAccountRule(record []string, line int) (models.AccountRule, error) {
+	for i := range record {
+		record[i] = strings.TrimSpace(record[i])
+	}
+	rule := models.AccountRule{
+		Line:       line,
+		Scope:      record[0],
+		Action:     record[1],
+		SourceCode: record[2],
+		TargetCode: record[3],
+	}
+	if rule.Scope == "" {
+		return rule, errors.New("scope is required, use * for every company")
+	}
+	if rule.SourceCode == "" {
+		return rule, errors.New("source_code is required")
+	}
+	switch rule.Action {
+	case ruleActionRemap:
+		if rule.TargetCode == "" {
+			return rule, errors.New("remap rule has no target_code")
+		}
+	case ruleActionDelete:
+		if rule.TargetCode != "" {
+			return rule, errors.New("delete rule must not have a target_code")
+		}
+	default:
+		return rule, fmt.Errorf("unknown action %q", rule.Action)
+	}
+	var err error
+	if record[4] != "" {
+		rule.EffectiveFrom, err = time.Parse("2006-01-02", record[4])
+		if err != nil {
+			return rule, fmt.Errorf("effective_from: %w", err)
+		}
+	}
+	if record[5] != "" {
+		rule.EffectiveTo, err = time.Parse("2006-01-02", record[5])
+		if err != nil {
+			return rule, fmt.Errorf("effective_to: %w", err)
+		}
+	}
+	if !rule.EffectiveTo.IsZero() && !rule.EffectiveTo.After(rule.EffectiveFrom) {
+		return rule, errors.New("effective_to must be after effective_from")
+	}
+	return rule, nil
+}
+
+// modifyAccountLookupTable combines a company's chart of accounts with the
+// rules that apply to it. Every remap target has to exist in the chart of
+// accounts; otherwise an error naming each offending rule is returned.
+func modifyAccountLookupTable(accountLookup map[string]models.AccountLookup, ruleSet models.AccountRuleSet, company string) (accountMapping, error) {
+	mapping := accountMapping{accounts: accountLookup}
+	missing := []string{}
+	for _, rule := range ruleSet.Rules {
+		if rule.Scope != ruleScopeAll && rule.Scope != company {
+			continue
+		}
+		if rule.Action == ruleActionRemap {
+			if _, ok := accountLookup[rule.TargetCode]; !ok {
+				missing = append(missing, fmt.Sprintf("line %d: %s -> %s", rule.Line, rule.SourceCode, rule.TargetCode))
+			}
+		}
+		mapping.rules = append(mapping.rules, rule)
+	}
+	if len(missing) > 0 {
+		return mapping, fmt.Errorf("account rules %s remap %s to accounts missing from the chart of accounts: %s", ruleSet.Version, company, strings.Join(missing, "; "))
+	}
+	// Company specific rules take precedence over rules for every company.
+	sort.SliceStable(mapping.rules, func(i, j int) bool {
+		return mapping.rules[i].Scope != ruleScopeAll && mapping.rules[j].Scope == ruleScopeAll
+	})
+	return mapping, nil
+}
+
+func (m accountMapping) lookup(code string, date time.Time) (models.AccountLookup, bool) {
+	if rule, ok := m.rule(code, date); ok {
+		if rule.Action == ruleActionDelete {
+			return models.AccountLookup{}, false
+		}
+		code = rule.TargetCode
+	}
+	account, ok := m.accounts[code]
+	return account, ok
+}
+
+// rule returns the rule that applies to code on date, if there is one.
+func (m accountMapping) rule(code string, date time.Time) (models.AccountRule, bool) {
+	for _, rule := range m.rules {
+		if rule.SourceCode != code {
+			continue
+		}
+		if !rule.EffectiveFrom.IsZero() && date.Before(rule.EffectiveFrom) {
+			continue
+		}
+		if !rule.EffectiveTo.IsZero() && !date.Before(rule.EffectiveTo) {
+			continue
+		}
+		return rule, true
+	}
+	return models.AccountRule{}, false
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/karman-dev-team/xero-transaction-bq-uploader/models"
+)
+
+const rulesHeader = "# version: 2024-10-01\nscope,action,source_code,target_code,effective_from,effective_to\n"
+
+func TestLoadAccountRules(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		want    []models.AccountRule
+		wantErr string
+	}{
+		{
+			name: "rules",
+			data: rulesHeader + "*,delete,9310,,,\nKD, remap ,4103,4201,2024-01-01,2025-01-01\n# a comment\n*,remap,4104,4201,,2024-06-01\n",
+			want: []models.AccountRule{
+				{Line: 3, Scope: "*", Action: ruleActionDelete, SourceCode: "9310"},
+				{Line: 4, Scope: "KD", Action: ruleActionRemap, SourceCode: "4103", TargetCode: "4201", EffectiveFrom: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), EffectiveTo: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)},
+				{Line: 6, Scope: "*", Action: ruleActionRemap, SourceCode: "4104", TargetCode: "4201", EffectiveTo: time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)},
+			},
+		},
+		{name: "no rules", data: rulesHeader},
+		{name: "no version", data: "scope,action,source_code,target_code,effective_from,effective_to\n", wantErr: "first line"},
+		{name: "empty version", data: "# version: \nscope,action,source_code,target_code,effective_from,effective_to\n", wantErr: "first line"},
+		{name: "wrong header", data: "# version: 1\nscope,action,source,target_code,effective_from,effective_to\n", wantErr: "expected column 3"},
+		{name: "missing column", data: rulesHeader + "*,delete,9310,,\n", wantErr: "wrong number of fields"},
+		{name: "no scope", data: rulesHeader + ",delete,9310,,,\n", wantErr: "line 3: scope is required"},
+		{name: "no source", data: rulesHeader + "*,delete,,,,\n", wantErr: "source_code is required"},
+		{name: "unknown action", data: rulesHeader + "*,move,9310,4201,,\n", wantErr: "unknown action"},
+		{name: "remap without target", data: rulesHeader + "*,remap,9310,,,\n", wantErr: "no target_code"},
+		{name: "delete with target", data: rulesHeader + "*,delete,9310,4201,,\n", wantErr: "must not have a target_code"},
+		{name: "bad date", data: rulesHeader + "*,delete,9310,,2024-13-01,\n", wantErr: "effective_from"},
+		{name: "empty period", data: rulesHeader + "*,delete,9310,,2024-01-01,2024-01-01\n", wantErr: "effective_to must be after"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "rules.csv")
+			err := os.WriteFile(path, []byte(test.data), 0o644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ruleSet, err := loadAccountRules(path)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("error = %v, want one containing %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ruleSet.Version != "2024-10-01" {
+				t.Errorf("version = %q", ruleSet.Version)
+			}
+			if len(ruleSet.Rules) != len(test.want) {
+				t.Fatalf("got %d rules, want %d: %+v", len(ruleSet.Rules), len(test.want), ruleSet.Rules)
+			}
+			for i, rule := range ruleSet.Rules {
+				if rule != test.want[i] {
+					t.Errorf("rule %d = %+v, want %+v", i, rule, test.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestLoadAccountRulesFile(t *testing.T) {
+	_, err := loadAccountRules(filepath.Join("..", "account_rules.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAccountMapping(t *testing.T) {
+	accounts := map[string]models.AccountLookup{
+		"4100": {Name: "Sales"},
+		"4200": {Name: "Services"},
+		"4201": {Name: "Consulting"},
+	}
+	ruleSet := models.AccountRuleSet{Version: "1", Rules: []models.AccountRule{
+		{Line: 3, Scope: "*", Action: ruleActionRemap, SourceCode: "4100", TargetCode: "4200"},
+		{Line: 4, Scope: "KD", Action: ruleActionRemap, SourceCode: "4100", TargetCode: "4201", EffectiveFrom: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), EffectiveTo: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{Line: 5, Scope: "*", Action: ruleActionDelete, SourceCode: "9310"},
+		{Line: 6, Scope: "CF", Action: ruleActionRemap, SourceCode: "4200", TargetCode: "4999"},
+	}}
+	mapping, err := modifyAccountLookupTable(accounts, ruleSet, "KD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		code   string
+		date   time.Time
+		want   string
+		wantOK bool
+	}{
+		{code: "4100", date: time.Date(2023, 6, 1, 0, 0, 0, 0, time.UTC), want: "Services", wantOK: true},
+		{code: "4100", date: time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC), want: "Consulting", wantOK: true},
+		{code: "4100", date: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), want: "Services", wantOK: true},
+		{code: "4200", date: time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC), want: "Services", wantOK: true},
+		{code: "9310", date: time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)},
+		{code: "5000", date: time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, test := range tests {
+		account, ok := mapping.lookup(test.code, test.date)
+		if ok != test.wantOK || account.Name != test.want {
+			t.Errorf("lookup(%s, %s) = %q, %t, want %q, %t", test.code, test.date.Format("2006-01-02"), account.Name, ok, test.want, test.wantOK)
+		}
+	}
+
+	_, err = modifyAccountLookupTable(accounts, ruleSet, "CF")
+	if err == nil || !strings.Contains(err.Error(), "line 6: 4200 -> 4999") {
+		t.Errorf("missing target error = %v", err)
+	}
+}
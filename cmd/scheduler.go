@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/karman-dev-team/xero-transaction-bq-uploader/models"
+)
+
+const (
+	scheduledRunning = "running"
+	scheduledSkipped = "skipped"
+	maxScheduledRuns = 50
+)
+
+var (
+	scheduledRunsMu sync.Mutex
+	scheduledRuns   []*models.ScheduledRun
+)
+
+// startScheduler imports each enabled tenant whenever one of its cron
+// schedules fires. The tenant config is re-read every minute, so schedule
+// changes apply without a restart. Each run is delayed by a random jitter of
+// up to SCHEDULE_JITTER, and a run is skipped if the tenant is still being
+// imported when it starts.
+func startScheduler(ctx context.Context) error {
+	jitter, err := time.ParseDuration(envOrDefault("SCHEDULE_JITTER", "2m"))
+	if err != nil {
+		return fmt.Errorf("parsing SCHEDULE_JITTER: %w", err)
+	}
+	go func() {
+		for {
+			now := time.Now()
+			next := now.Truncate(time.Minute).Add(time.Minute)
+			if sleepContext(ctx, next.Sub(now)) != nil {
+				return
+			}
+			runDueSchedules(ctx, next, jitter)
+		}
+	}()
+	return nil
+}
+
+func runDueSchedules(ctx context.Context, now time.Time, jitter time.Duration) {
+	config, err := loadTenants()
+	if err != nil {
+		fmt.Println("Error loading tenants for scheduler", err)
+		return
+	}
+	for _, tenant := range config.Tenants {
+		if !tenant.Enabled {
+			continue
+		}
+		for _, expr := range tenant.Schedules {
+			schedule, err := parseCron(expr)
+			if err != nil {
+				if now.Minute() == 0 {
+					recordScheduledRun(&models.ScheduledRun{Tenant: tenant.Company, Schedule: expr, Due: now, Status: jobFailed, Message: err.Error()})
+				}
+				continue
+			}
+			if schedule.matches(now) {
+				// Several schedules firing at once still mean a single run.
+				go runScheduledImport(ctx, tenant, expr, now, jitter)
+				break
+			}
+		}
+	}
+}
+
+func runScheduledImport(ctx context.Context, tenant models.XeroCompany, expr string, due time.Time, jitter time.Duration) {
+	if jitter > 0 {
+		if sleepContext(ctx, time.Duration(rand.Int63n(int64(jitter)))) != nil {
+			return
+		}
+	}
+	run := &models.ScheduledRun{
+		Tenant:   tenant.Company,
+		Schedule: expr,
+		Due:      due,
+		Started:  time.Now(),
+		Status:   scheduledRunning,
+	}
+	recordScheduledRun(run)
+	msg, err := importXeroData(ctx, models.ImportOptions{Tenants: []string{tenant.Company}}, nil)
+
+	scheduledRunsMu.Lock()
+	defer scheduledRunsMu.Unlock()
+	run.Finished = time.Now()
+	run.Status = jobSucceeded
+	run.Message = msg
+	if err != nil {
+		run.Status = jobFailed
+		if errors.Is(err, errTenantBusy) {
+			run.Status = scheduledSkipped
+		}
+		run.Message = err.Error()
+		fmt.Printf("Scheduled import of %s %s: %v\n", tenant.Company, run.Status, err)
+	}
+}
+
+func recordScheduledRun(run *models.ScheduledRun) {
+	scheduledRunsMu.Lock()
+	defer scheduledRunsMu.Unlock()
+	scheduledRuns = append(scheduledRuns, run)
+	if len(scheduledRuns) > maxScheduledRuns {
+		scheduledRuns = scheduledRuns[len(scheduledRuns)-maxScheduledRuns:]
+	}
+}
+
+// recentScheduledRuns returns the latest scheduled runs, newest first.
+func recentScheduledRuns() []models.ScheduledRun {
+	scheduledRunsMu.Lock()
+	defer scheduledRunsMu.Unlock()
+	runs := []models.ScheduledRun{}
+	for i := len(scheduledRuns) - 1; i >= 0; i-- {
+		runs = append(runs, *scheduledRuns[i])
+	}
+	return runs
+}
+
+// nextScheduledRuns returns when each enabled tenant's schedules fire next.
+func nextScheduledRuns(config models.TenantConfig, now time.Time) []models.ScheduledRun {
+	runs := []models.ScheduledRun{}
+	for _, tenant := range config.Tenants {
+		if !tenant.Enabled {
+			continue
+		}
+		for _, expr := range tenant.Schedules {
+			run := models.ScheduledRun{Tenant: tenant.Company, Schedule: expr}
+			schedule, err := parseCron(expr)
+			if err != nil {
+				run.Message = err.Error()
+			} else {
+				run.Due = schedule.next(now)
+			}
+			runs = append(runs, run)
+		}
+	}
+	return runs
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/karman-dev-team/xero-transaction-bq-uploader/models"
+	"google.golang.org/api/googleapi"
+)
+
+// bqTableSpec describes a table the uploader owns: its schema is inferred
+// from a model struct and it is created with the given layout when missing.
+type bqTableSpec struct {
+	Model          any
+	PartitionField string
+	ClusterFields  []string
+}
+
+var transactionsTableSpec = bqTableSpec{
+	Model:          models.BQTransaction{},
+	PartitionField: "date",
+	ClusterFields:  []string{"company", "account_code"},
+}
+
+var invoicesTableSpec = bqTableSpec{
+	Model:          models.BQInvoice{},
+	PartitionField: "date",
+	ClusterFields:  []string{"company", "status"},
+}
+
+var creditNotesTableSpec = bqTableSpec{
+	Model:          models.BQCreditNote{},
+	PartitionField: "date",
+	ClusterFields:  []string{"company", "status"},
+}
+
+var contactsTableSpec = bqTableSpec{
+	Model:         models.BQContact{},
+	ClusterFields: []string{"company"},
+}
+
+var trackingTableSpec = bqTableSpec{
+	Model:         models.BQTrackingCategory{},
+	ClusterFields: []string{"company"},
+}
+
+var exceptionsTableSpec = bqTableSpec{
+	Model:          models.BQException{},
+	PartitionField: "run_at",
+	ClusterFields:  []string{"company"},
+}
+
+var paymentsTableSpec = bqTableSpec{
+	Model:          models.BQPayment{},
+	PartitionField: "date",
+	ClusterFields:  []string{"company", "invoice_id"},
+}
+
+var overpaymentsTableSpec = bqTableSpec{
+	Model:          models.BQOverpayment{},
+	PartitionField: "date",
+	ClusterFields:  []string{"company", "status"},
+}
+
+var prepaymentsTableSpec = bqTableSpec{
+	Model:          models.BQPrepayment{},
+	PartitionField: "date",
+	ClusterFields:  []string{"company", "status"},
+}
+
+// ensureBQTable creates the destination table if it does not exist and adds
+// any columns the model has gained since. Type or mode changes cannot be
+// applied without rewriting the table, so they are refused and returned in
+// the error; columns that are no longer in the model are left in place. The
+// diff is returned either way, for the caller to report.
+func ensureBQTable(ctx context.Context, destination models.BQDestination, spec bqTableSpec) (models.SchemaDiff, error) {
+	tableName := fmt.Sprintf("%s.%s.%s", destination.ProjectID, destination.DatasetID, destination.TableID)
+	diff := models.SchemaDiff{Table: tableName}
+	schema, err := bigquery.InferSchema(spec.Model)
+	if err != nil {
+		return diff, err
+	}
+	schema = relaxSchema(schema)
+
+	client, err := bigquery.NewClient(ctx, destination.ProjectID)
+	if err != nil {
+		return diff, err
+	}
+	defer client.Close()
+
+	table := client.Dataset(destination.DatasetID).Table(destination.TableID)
+	metadata, err := table.Metadata(ctx)
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound {
+		tableMetadata := &bigquery.TableMetadata{Schema: schema}
+		if spec.PartitionField != "" {
+			tableMetadata.TimePartitioning = &bigquery.TimePartitioning{
+				Type:  bigquery.DayPartitioningType,
+				Field: spec.PartitionField,
+			}
+		}
+		if len(spec.ClusterFields) > 0 {
+			tableMetadata.Clustering = &bigquery.Clustering{Fields: spec.ClusterFields}
+		}
+		err = table.Create(ctx, tableMetadata)
+		if err != nil {
+			return diff, fmt.Errorf("creating BigQuery table %s: %w", tableName, err)
+		}
+		for _, field := range schema {
+			diff.Added = append(diff.Added, field.Name)
+		}
+		fmt.Printf("Created BigQuery table %s\n", tableName)
+		return diff, nil
+	}
+	if err != nil {
+		return diff, err
+	}
+
+	migrated := diffSchema("", metadata.Schema, schema, &diff)
+	if len(diff.Destructive) > 0 {
+		return diff, fmt.Errorf("BigQuery table %s needs destructive schema changes: %s", tableName, strings.Join(diff.Destructive, "; "))
+	}
+	if len(diff.Added) == 0 {
+		return diff, nil
+	}
+	_, err = table.Update(ctx, bigquery.TableMetadataToUpdate{Schema: migrated}, metadata.ETag)
+	if err != nil {
+		return diff, fmt.Errorf("adding columns %s to BigQuery table %s: %w", strings.Join(diff.Added, ", "), tableName, err)
+	}
+	return diff, nil
+}
+
+// describeSchemaDiff summarises diff in a line, or returns "" when the table
+// already matched the model.
+func describeSchemaDiff(diff models.SchemaDiff) string {
+	parts := []string{}
+	if len(diff.Added) > 0 {
+		parts = append(parts, "added "+strings.Join(diff.Added, ", "))
+	}
+	if len(diff.Removed) > 0 {
+		parts = append(parts, "not in the model, left in place: "+strings.Join(diff.Removed, ", "))
+	}
+	if len(diff.Destructive) > 0 {
+		parts = append(parts, "refused: "+strings.Join(diff.Destructive, "; "))
+	}
+	return strings.Join(parts, "; ")
+}
+
+// diffSchema compares the current table schema with the one inferred from the
+// model, recording the differences in diff. It returns the current schema
+// with the model's new columns appended, which is safe to apply as an update.
+func diffSchema(prefix string, current bigquery.Schema, wanted bigquery.Schema, diff *models.SchemaDiff) bigquery.Schema {
+	existing := make(map[string]*bigquery.FieldSchema)
+	for _, field := range current {
+		existing[field.Name] = field
+	}
+	inModel := make(map[string]bool)
+	migrated := bigquery.Schema{}
+	for _, field := range current {
+		copied := *field
+		migrated = append(migrated, &copied)
+	}
+	for _, field := range wanted {
+		name := prefix + field.Name
+		inModel[field.Name] = true
+		currentField, ok := existing[field.Name]
+		if !ok {
+			diff.Added = append(diff.Added, name)
+			migrated = append(migrated, field)
+			continue
+		}
+		if currentField.Type != field.Type {
+			diff.Destructive = append(diff.Destructive, fmt.Sprintf("%s changes type from %s to %s", name, currentField.Type, field.Type))
+			continue
+		}
+		if currentField.Repeated != field.Repeated {
+			diff.Destructive = append(diff.Destructive, fmt.Sprintf("%s changes repeated from %t to %t", name, currentField.Repeated, field.Repeated))
+			continue
+		}
+		if field.Type == bigquery.RecordFieldType {
+			for _, migratedField := range migrated {
+				if migratedField.Name == field.Name {
+					migratedField.Schema = diffSchema(name+".", currentField.Schema, field.Schema, diff)
+				}
+			}
+		}
+	}
+	for _, field := range current {
+		if !inModel[field.Name] {
+			diff.Removed = append(diff.Removed, prefix+field.Name)
+		}
+	}
+	return migrated
+}
+
+// relaxSchema marks every field as nullable. InferSchema makes non-pointer
+// fields required, but BigQuery only allows nullable columns to be added to
+// an existing table.
+func relaxSchema(schema bigquery.Schema) bigquery.Schema {
+	relaxed := bigquery.Schema{}
+	for _, field := range schema {
+		copied := *field
+		copied.Required = false
+		if copied.Schema != nil {
+			copied.Schema = relaxSchema(copied.Schema)
+		}
+		relaxed = append(relaxed, &copied)
+	}
+	return relaxed
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/karman-dev-team/xero-transaction-bq-uploader/models"
+)
+
+func TestDiffSchema(t *testing.T) {
+	str := func(name string) *bigquery.FieldSchema {
+		return &bigquery.FieldSchema{Name: name, Type: bigquery.StringFieldType}
+	}
+	record := func(name string, repeated bool, fields ...*bigquery.FieldSchema) *bigquery.FieldSchema {
+		return &bigquery.FieldSchema{Name: name, Type: bigquery.RecordFieldType, Repeated: repeated, Schema: fields}
+	}
+	tests := []struct {
+		name     string
+		current  bigquery.Schema
+		wanted   bigquery.Schema
+		want     models.SchemaDiff
+		migrated []string
+	}{
+		{
+			name:     "same",
+			current:  bigquery.Schema{str("id"), str("company")},
+			wanted:   bigquery.Schema{str("id"), str("company")},
+			migrated: []string{"id", "company"},
+		},
+		{
+			name:     "added",
+			current:  bigquery.Schema{str("id")},
+			wanted:   bigquery.Schema{str("id"), str("company")},
+			want:     models.SchemaDiff{Added: []string{"company"}},
+			migrated: []string{"id", "company"},
+		},
+		{
+			name:     "removed columns stay",
+			current:  bigquery.Schema{str("id"), str("old")},
+			wanted:   bigquery.Schema{str("id")},
+			want:     models.SchemaDiff{Removed: []string{"old"}},
+			migrated: []string{"id", "old"},
+		},
+		{
+			name:     "type change",
+			current:  bigquery.Schema{str("id"), str("amount")},
+			wanted:   bigquery.Schema{str("id"), {Name: "amount", Type: bigquery.FloatFieldType}},
+			want:     models.SchemaDiff{Destructive: []string{"amount changes type from STRING to FLOAT"}},
+			migrated: []string{"id", "amount"},
+		},
+		{
+			name:     "repeated change",
+			current:  bigquery.Schema{str("tags")},
+			wanted:   bigquery.Schema{{Name: "tags", Type: bigquery.StringFieldType, Repeated: true}},
+			want:     models.SchemaDiff{Destructive: []string{"tags changes repeated from false to true"}},
+			migrated: []string{"tags"},
+		},
+		{
+			name:     "nested",
+			current:  bigquery.Schema{str("id"), record("tracking", true, str("category"), str("old"))},
+			wanted:   bigquery.Schema{str("id"), record("tracking", true, str("category"), str("option"))},
+			want:     models.SchemaDiff{Added: []string{"tracking.option"}, Removed: []string{"tracking.old"}},
+			migrated: []string{"id", "tracking", "tracking.category", "tracking.old", "tracking.option"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			diff := models.SchemaDiff{}
+			migrated := diffSchema("", test.current, test.wanted, &diff)
+			if !reflect.DeepEqual(diff, test.want) {
+				t.Errorf("diff = %+v, want %+v", diff, test.want)
+			}
+			if names := schemaNames("", migrated); !reflect.DeepEqual(names, test.migrated) {
+				t.Errorf("migrated = %v, want %v", names, test.migrated)
+			}
+		})
+	}
+}
+
+func TestDiffSchemaKeepsCurrent(t *testing.T) {
+	current := bigquery.Schema{{Name: "tracking", Type: bigquery.RecordFieldType, Schema: bigquery.Schema{{Name: "category", Type: bigquery.StringFieldType}}}}
+	wanted := bigquery.Schema{{Name: "tracking", Type: bigquery.RecordFieldType, Schema: bigquery.Schema{{Name: "category", Type: bigquery.StringFieldType}, {Name: "option", Type: bigquery.StringFieldType}}}}
+	diffSchema("", current, wanted, &models.SchemaDiff{})
+	if len(current[0].Schema) != 1 {
+		t.Errorf("current schema was changed: %v", schemaNames("", current))
+	}
+}
+
+func schemaNames(prefix string, schema bigquery.Schema) []string {
+	names := []string{}
+	for _, field := range schema {
+		names = append(names, prefix+field.Name)
+		names = append(names, schemaNames(prefix+field.Name+".", field.Schema)...)
+	}
+	return names
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/karman-dev-team/xero-transaction-bq-uploader/models"
+)
+
+// sink is a destination for the ledger rows of an import. open returns the
+// writer for the rows of one tenant; see newBQWriter for fullSync.
+type sink interface {
+	open(ctx context.Context, report progressFunc, tenant models.XeroCompany, runID string, fullSync bool) (rowWriter[models.BQTransaction], error)
+}
+
+var sinkBackends = map[string]func() (sink, error){
+	"bigquery": func() (sink, error) {
+		return bqSink{}, nil
+	},
+	"csv": func() (sink, error) {
+		return newFileSink(fileFormatCSV)
+	},
+	"ndjson": func() (sink, error) {
+		return newFileSink(fileFormatNDJSON)
+	},
+	"parquet": func() (sink, error) {
+		return newFileSink(fileFormatParquet)
+	},
+}
+
+// newSinks returns the sinks named in OUTPUT_SINKS, a comma separated list
+// that defaults to bigquery.
+func newSinks() ([]sink, error) {
+	sinks := []sink{}
+	for _, name := range strings.Split(envOrDefault("OUTPUT_SINKS", "bigquery"), ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		factory, ok := sinkBackends[name]
+		if !ok {
+			names := []string{}
+			for backend := range sinkBackends {
+				names = append(names, backend)
+			}
+			sort.Strings(names)
+			return nil, fmt.Errorf("unknown sink %q in OUTPUT_SINKS, expected some of %s", name, strings.Join(names, ", "))
+		}
+		s, err := factory()
+		if err != nil {
+			return nil, fmt.Errorf("creating %s sink: %w", name, err)
+		}
+		sinks = append(sinks, s)
+	}
+	if len(sinks) == 0 {
+		return nil, errors.New("OUTPUT_SINKS names no sinks")
+	}
+	return sinks, nil
+}
+
+// hasBQSink reports whether the ledger rows are written to BigQuery, which
+// the steps that update the transactions table after the import rely on.
+func hasBQSink(sinks []sink) bool {
+	for _, s := range sinks {
+		if _, ok := s.(bqSink); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// openSinks opens every sink for one tenant and returns a writer that writes
+// to all of them. BigQuery comes first, so that the files are only kept when
+// BigQuery has kept the rows too.
+func openSinks(ctx context.Context, report progressFunc, sinks []sink, tenant models.XeroCompany, runID string, fullSync bool) (rowWriter[models.BQTransaction], error) {
+	ordered := []sink{}
+	for _, s := range sinks {
+		if _, ok := s.(bqSink); ok {
+			ordered = append([]sink{s}, ordered...)
+		} else {
+			ordered = append(ordered, s)
+		}
+	}
+	writers := multiWriter[models.BQTransaction]{}
+	for _, s := range ordered {
+		writer, err := s.open(ctx, report, tenant, runID, fullSync)
+		if err != nil {
+			cancelled, cancel := context.WithCancel(ctx)
+			cancel()
+			writers.Close(cancelled)
+			return nil, err
+		}
+		writers = append(writers, writer)
+	}
+	if len(writers) == 1 {
+		return writers[0], nil
+	}
+	return writers, nil
+}
+
+// bqSink writes the rows to the tenant's BigQuery table.
+type bqSink struct{}
+
+func (bqSink) open(ctx context.Context, report progressFunc, tenant models.XeroCompany, runID string, fullSync bool) (rowWriter[models.BQTransaction], error) {
+	return newBQWriter[models.BQTransaction](ctx, report, tenant.Company, tenantDestination(tenant), fullSync)
+}
+
+// multiWriter writes every batch to each of its writers in turn. Close closes
+// them in the same order; once one fails, the rest are closed with a
+// cancelled context so that they discard their rows as well.
+type multiWriter[T any] []rowWriter[T]
+
+func (w multiWriter[T]) Write(ctx context.Context, rows []T) error {
+	for _, writer := range w {
+		err := writer.Write(ctx, rows)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w multiWriter[T]) Close(ctx context.Context) error {
+	errs := []error{}
+	for _, writer := range w {
+		err := writer.Close(ctx)
+		if err != nil && ctx.Err() == nil {
+			cancelled, cancel := context.WithCancel(ctx)
+			cancel()
+			ctx = cancelled
+		}
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/karman-dev-team/xero-transaction-bq-uploader/models"
+)
+
+const (
+	bankTransactionsEndpoint = "BankTransactions"
+	journalsEndpoint         = "Journals"
+	invoicesEndpoint         = "Invoices"
+	creditNotesEndpoint      = "CreditNotes"
+	paymentsEndpoint         = "Payments"
+	overpaymentsEndpoint     = "Overpayments"
+	prepaymentsEndpoint      = "Prepayments"
+	contactsEndpoint         = "Contacts"
+	trackingEndpoint         = "TrackingCategories"
+)
+
+// syncStateMu serialises writes to the sync state file across the imports
+// running in this process.
+var syncStateMu sync.Mutex
+
+// syncStore keeps the per-tenant high-water marks used to request only the
+// records that changed since the previous import.
+type syncStore struct {
+	mu     sync.Mutex
+	path   string
+	states map[string]models.SyncState
+}
+
+func loadSyncStore(path string) (*syncStore, error) {
+	syncStateMu.Lock()
+	defer syncStateMu.Unlock()
+	states, err := readSyncStates(path)
+	if err != nil {
+		return nil, err
+	}
+	return &syncStore{path: path, states: states}, nil
+}
+
+func readSyncStates(path string) (map[string]models.SyncState, error) {
+	states := make(map[string]models.SyncState)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return states, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &states)
+	if err != nil {
+		return nil, err
+	}
+	return states, nil
+}
+
+func (s *syncStore) get(tenantID string) models.SyncState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state, ok := s.states[tenantID]
+	if !ok {
+		state = models.SyncState{TenantID: tenantID}
+	}
+	if state.ModifiedSince == nil {
+		state.ModifiedSince = make(map[string]time.Time)
+	}
+	return state
+}
+
+// put saves the state of one tenant. The file is read again so that the
+// states other imports saved since this store was loaded are kept.
+func (s *syncStore) put(state models.SyncState) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	syncStateMu.Lock()
+	defer syncStateMu.Unlock()
+	states, err := readSyncStates(s.path)
+	if err != nil {
+		return err
+	}
+	states[state.TenantID] = state
+	data, err := json.MarshalIndent(states, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = writeFileAtomic(s.path, data)
+	if err != nil {
+		return err
+	}
+	s.states = states
+	return nil
+}
+
+func syncStatePath() string {
+	return envOrDefault("SYNC_STATE_FILE", "sync_state.json")
+}
+
+func latestUpdatedDate(transactions []models.XeroTransaction, current time.Time) (time.Time, error) {
+	latest := current
+	for _, transaction := range transactions {
+		updated, err := parseXeroDate(transaction.UpdatedDateUTC)
+		if err != nil {
+			return latest, err
+		}
+		if updated.After(latest) {
+			latest = updated
+		}
+	}
+	return latest, nil
+}
+
+func latestJournalNumber(journals []models.Journal, current int) int {
+	latest := current
+	for _, journal := range journals {
+		if journal.JournalNumber > latest {
+			latest = journal.JournalNumber
+		}
+	}
+	return latest
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/karman-dev-team/xero-transaction-bq-uploader/models"
+	"golang.org/x/oauth2"
+)
+
+var defaultExcludedAccountCodes = []string{"7003"}
+
+var tenantsMu sync.Mutex
+
+var (
+	tenantLocksMu sync.Mutex
+	tenantLocks   = make(map[string]bool)
+)
+
+var errTenantBusy = errors.New("an import is already running for")
+
+var errInvalidCompany = errors.New("invalid company code")
+
+// companyCodePattern is what a company code may contain. The code names the
+// tenant's staging table and output directory.
+var companyCodePattern = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+
+func tenantsPath() string {
+	return envOrDefault("TENANTS_FILE", "tenants.json")
+}
+
+// loadTenants reads the tenant config file. When it does not exist yet the
+// CF_TENANT_ID and KD_TENANT_ID environment variables are used instead.
+func loadTenants() (models.TenantConfig, error) {
+	tenantsMu.Lock()
+	defer tenantsMu.Unlock()
+	return readTenants()
+}
+
+func readTenants() (models.TenantConfig, error) {
+	config := models.TenantConfig{}
+	data, err := os.ReadFile(tenantsPath())
+	if errors.Is(err, os.ErrNotExist) {
+		for _, tenant := range []models.XeroCompany{
+			{ID: os.Getenv("CF_TENANT_ID"), Company: "CF"},
+			{ID: os.Getenv("KD_TENANT_ID"), Company: "KD"}} {
+			if tenant.ID != "" {
+				tenant.Enabled = true
+				config.Tenants = append(config.Tenants, tenant)
+			}
+		}
+		return config, nil
+	}
+	if err != nil {
+		return config, err
+	}
+	err = json.Unmarshal(data, &config)
+	if err != nil {
+		return config, fmt.Errorf("parsing %s: %w", tenantsPath(), err)
+	}
+	return config, nil
+}
+
+// updateTenants applies update to the tenant config and saves it, holding
+// the lock throughout so that concurrent updates are not lost. The config is
+// not saved if its company codes are not valid.
+func updateTenants(update func(config *models.TenantConfig) error) error {
+	tenantsMu.Lock()
+	defer tenantsMu.Unlock()
+	config, err := readTenants()
+	if err != nil {
+		return err
+	}
+	err = update(&config)
+	if err != nil {
+		return err
+	}
+	err = validateCompanies(config)
+	if err != nil {
+		return err
+	}
+	return writeTenants(config)
+}
+
+func writeTenants(config models.TenantConfig) error {
+	data, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(tenantsPath(), data, 0644)
+}
+
+// validateCompanies checks that the company codes are valid and that no two
+// tenants share one, ignoring case. Rows, account mappings and staging tables
+// are all keyed by the code, so a shared one mixes up the tenants' data.
+func validateCompanies(config models.TenantConfig) error {
+	seen := make(map[string]string)
+	for _, tenant := range config.Tenants {
+		if tenant.Company == "" {
+			continue
+		}
+		if !companyCodePattern.MatchString(tenant.Company) {
+			return fmt.Errorf("%w %q for tenant %q: use only letters, digits and underscores", errInvalidCompany, tenant.Company, tenant.Name)
+		}
+		code := strings.ToLower(tenant.Company)
+		if other, ok := seen[code]; ok {
+			return fmt.Errorf("%w %q: tenants %q and %q both use it", errInvalidCompany, tenant.Company, other, tenant.Name)
+		}
+		seen[code] = tenant.Name
+	}
+	return nil
+}
+
+func enabledTenants(config models.TenantConfig) ([]models.XeroCompany, error) {
+	err := validateCompanies(config)
+	if err != nil {
+		return nil, err
+	}
+	tenants := []models.XeroCompany{}
+	for _, tenant := range config.Tenants {
+		if !tenant.Enabled {
+			continue
+		}
+		if tenant.ID == "" || tenant.Company == "" {
+			return nil, fmt.Errorf("tenant %q is enabled but has no tenant ID or company code", tenant.Name)
+		}
+		tenants = append(tenants, tenant)
+	}
+	if len(tenants) == 0 {
+		return nil, errors.New("no tenants are enabled")
+	}
+	return tenants, nil
+}
+
+// selectTenants narrows tenants down to the given company codes. An empty
+// list selects every tenant.
+func selectTenants(tenants []models.XeroCompany, companies []string) ([]models.XeroCompany, error) {
+	if len(companies) == 0 {
+		return tenants, nil
+	}
+	selected := []models.XeroCompany{}
+	for _, company := range companies {
+		found := false
+		for _, tenant := range tenants {
+			if strings.EqualFold(tenant.Company, company) {
+				selected = append(selected, tenant)
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("no enabled tenant with company code %q", company)
+		}
+	}
+	return selected, nil
+}
+
+// lockTenants marks tenants as being imported so that two imports of the same
+// tenant never overlap. It fails without locking anything if any of them is
+// already locked; otherwise the returned function releases the locks.
+func lockTenants(tenants []models.XeroCompany) (func(), error) {
+	tenantLocksMu.Lock()
+	defer tenantLocksMu.Unlock()
+	busy := []string{}
+	for _, tenant := range tenants {
+		if tenantLocks[tenant.ID] {
+			busy = append(busy, tenant.Company)
+		}
+	}
+	if len(busy) > 0 {
+		return nil, fmt.Errorf("%w %s", errTenantBusy, strings.Join(busy, ", "))
+	}
+	for _, tenant := range tenants {
+		tenantLocks[tenant.ID] = true
+	}
+	return func() {
+		tenantLocksMu.Lock()
+		defer tenantLocksMu.Unlock()
+		for _, tenant := range tenants {
+			delete(tenantLocks, tenant.ID)
+		}
+	}, nil
+}
+
+func excludedAccountCodes(tenant models.XeroCompany) []string {
+	if tenant.ExcludedAccountCodes != nil {
+		return tenant.ExcludedAccountCodes
+	}
+	return defaultExcludedAccountCodes
+}
+
+// tenantDestination returns the BigQuery table a tenant's rows are written
+// to, applying any per-tenant dataset or table override.
+func tenantDestination(tenant models.XeroCompany) models.BQDestination {
+	destination := bqDestination
+	if tenant.BQDataset != "" {
+		destination.DatasetID = tenant.BQDataset
+	}
+	if tenant.BQTable != "" {
+		destination.TableID = tenant.BQTable
+	}
+	return destination
+}
+
+// tenantTable returns a table in the tenant's dataset. Per-tenant table
+// overrides only apply to the transactions table.
+func tenantTable(tenant models.XeroCompany, table string) models.BQDestination {
+	destination := tenantDestination(tenant)
+	destination.TableID = table
+	return destination
+}
+
+// discoverTenants adds every organisation the token is connected to that is
+// not in the tenant config yet. New tenants start disabled so that they have
+// to be given a company code and selected before they are imported.
+func discoverTenants(ctx context.Context, tokenSource oauth2.TokenSource) error {
+	connections, err := getConnections(ctx, tokenSource)
+	if err != nil {
+		return err
+	}
+	return updateTenants(func(config *models.TenantConfig) error {
+		known := make(map[string]bool)
+		for _, tenant := range config.Tenants {
+			known[tenant.ID] = true
+		}
+		for _, connection := range connections {
+			if connection.TenantType != "ORGANISATION" || known[connection.TenantID] {
+				continue
+			}
+			config.Tenants = append(config.Tenants, models.XeroCompany{
+				ID:   connection.TenantID,
+				Name: connection.TenantName,
+			})
+		}
+		return nil
+	})
+}
+
+func getConnections(ctx context.Context, tokenSource oauth2.TokenSource) ([]models.XeroConnection, error) {
+	connections := []models.XeroConnection{}
+	req, err := http.NewRequestWithContext(ctx, "GET", "https://api.xero.com/connections", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Accept", "application/json")
+	client := oauth2.NewClient(ctx, tokenSource)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		fmt.Printf("body: %s\n", body)
+		return nil, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	err = json.Unmarshal(body, &connections)
+	if err != nil {
+		return nil, err
+	}
+	return connections, nil
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/oauth2"
+)
+
+// tokenStore persists the Xero OAuth token so that imports keep working across
+// restarts. Load returns a nil token when nothing has been saved yet.
+type tokenStore interface {
+	Load() (*oauth2.Token, error)
+	Save(token *oauth2.Token) error
+}
+
+var tokenStoreBackends = map[string]func() (tokenStore, error){
+	"memory": func() (tokenStore, error) {
+		return &memoryTokenStore{}, nil
+	},
+	"file": func() (tokenStore, error) {
+		return &fileTokenStore{path: envOrDefault("TOKEN_FILE", "token.json")}, nil
+	},
+	"encrypted-file": func() (tokenStore, error) {
+		key, err := base64.StdEncoding.DecodeString(os.Getenv("TOKEN_ENCRYPTION_KEY"))
+		if err != nil {
+			return nil, fmt.Errorf("decoding TOKEN_ENCRYPTION_KEY: %w", err)
+		}
+		if len(key) != 32 {
+			return nil, errors.New("TOKEN_ENCRYPTION_KEY must be 32 bytes, base64 encoded")
+		}
+		return &encryptedFileTokenStore{path: envOrDefault("TOKEN_FILE", "token.enc"), key: key}, nil
+	},
+}
+
+func newTokenStore() (tokenStore, error) {
+	name := envOrDefault("TOKEN_STORE", "file")
+	factory, ok := tokenStoreBackends[name]
+	if !ok {
+		names := []string{}
+		for backend := range tokenStoreBackends {
+			names = append(names, backend)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown TOKEN_STORE %q, expected one of %s", name, strings.Join(names, ", "))
+	}
+	return factory()
+}
+
+type memoryTokenStore struct {
+	mu    sync.Mutex
+	token *oauth2.Token
+}
+
+func (s *memoryTokenStore) Load() (*oauth2.Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.token, nil
+}
+
+func (s *memoryTokenStore) Save(token *oauth2.Token) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.token = token
+	return nil
+}
+
+type fileTokenStore struct {
+	path string
+}
+
+func (s *fileTokenStore) Load() (*oauth2.Token, error) {
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	token := &oauth2.Token{}
+	err = json.Unmarshal(data, token)
+	if err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+func (s *fileTokenStore) Save(token *oauth2.Token) error {
+	data, err := json.Marshal(token)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, data)
+}
+
+// encryptedFileTokenStore keeps the token in a file sealed with AES-256-GCM.
+type encryptedFileTokenStore struct {
+	path string
+	key  []byte
+}
+
+func (s *encryptedFileTokenStore) Load() (*oauth2.Token, error) {
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := s.cipher()
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < gcm.NonceSize() {
+		return nil, fmt.Errorf("%s is too short to be an encrypted token", s.path)
+	}
+	nonce, sealed := data[:gcm.NonceSize()], data[gcm.NonceSize():]
+	plain, err := gcm.Open(nil, nonce, sealed, nil)
+	if err != nil {
+		return nil, fmt.Errorf("decrypting %s: %w", s.path, err)
+	}
+	token := &oauth2.Token{}
+	err = json.Unmarshal(plain, token)
+	if err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+func (s *encryptedFileTokenStore) Save(token *oauth2.Token) error {
+	plain, err := json.Marshal(token)
+	if err != nil {
+		return err
+	}
+	gcm, err := s.cipher()
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, gcm.Seal(nonce, nonce, plain, nil))
+}
+
+func (s *encryptedFileTokenStore) cipher() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(s.key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func writeFileAtomic(path string, data []byte) error {
+	tmpPath := path + ".tmp"
+	err := os.WriteFile(tmpPath, data, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// persistingTokenSource refreshes the token when it expires and writes every
+// new token back to the store. Xero rotates the refresh token on each use,
+// so a token that is not saved cannot be used again after a restart.
+type persistingTokenSource struct {
+	mu     sync.Mutex
+	source oauth2.TokenSource
+	store  tokenStore
+	last   *oauth2.Token
+}
+
+func (s *persistingTokenSource) Token() (*oauth2.Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	token, err := s.source.Token()
+	if err != nil {
+		return nil, err
+	}
+	if s.last == nil || token.AccessToken != s.last.AccessToken || token.RefreshToken != s.last.RefreshToken {
+		err = s.store.Save(token)
+		if err != nil {
+			return nil, fmt.Errorf("saving refreshed token: %w", err)
+		}
+		s.last = token
+	}
+	return token, nil
+}
+
+var (
+	appMu         sync.Mutex
+	appTokenStore tokenStore
+)
+
+// setToken makes token the one used for Xero calls and saves it.
+func setToken(token *oauth2.Token) error {
+	err := appTokenStore.Save(token)
+	if err != nil {
+		return err
+	}
+	source := &persistingTokenSource{
+		source: oauth2Config.TokenSource(context.Background(), token),
+		store:  appTokenStore,
+		last:   token,
+	}
+	appMu.Lock()
+	defer appMu.Unlock()
+	App.TokenSource = source
+	return nil
+}
+
+// loadSavedToken restores the token saved by a previous run, if any.
+func loadSavedToken() error {
+	store, err := newTokenStore()
+	if err != nil {
+		return err
+	}
+	appTokenStore = store
+	token, err := store.Load()
+	if err != nil {
+		return err
+	}
+	if token == nil {
+		return nil
+	}
+	return setToken(token)
+}
+
+func currentTokenSource() oauth2.TokenSource {
+	appMu.Lock()
+	defer appMu.Unlock()
+	return App.TokenSource
+}
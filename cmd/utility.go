@@ -1,29 +1,31 @@
 package main
 
 import (
+	"fmt"
 	"math"
 	"regexp"
+	"slices"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/karman-dev-team/xero-transaction-bq-uploader/models"
 )
 
-func mergeTransactionsAndJournals(transactions []models.XeroTransaction, journals []models.Journal) ([]models.AccountTransaction, error) {
-	journalAcccountTransactions, err := convertJournalsToAccountTransactions(journals)
-	if err != nil {
-		return nil, err
-	}
-	transactionAccountTransactions, err := convertTransactionsToAccountTransactions(transactions)
-	if err != nil {
-		return nil, err
+var xeroDatePattern = regexp.MustCompile(`/Date\((\d+)(?:[+-]\d+)?\)/`)
+
+// parseXeroDate parses the /Date(1573755038314+0000)/ format used by the Xero
+// API. A zero time is returned when dateStr is not in that format.
+func parseXeroDate(dateStr string) (time.Time, error) {
+	dateSplit := xeroDatePattern.FindStringSubmatch(dateStr)
+	if len(dateSplit) < 2 {
+		return time.Time{}, nil
 	}
-	filteredTransactionAccountTransactions, err := filterBankAccountTransactions(transactionAccountTransactions)
+	dateUnix, err := strconv.ParseInt(dateSplit[1], 10, 64)
 	if err != nil {
-		return nil, err
+		return time.Time{}, err
 	}
-	accountTransactions := append(journalAcccountTransactions, filteredTransactionAccountTransactions...)
-	return accountTransactions, nil
+	return time.UnixMilli(dateUnix), nil
 }
 
 func convertJournalsToAccountTransactions(journals []models.Journal) ([]models.AccountTransaction, error) {
@@ -31,17 +33,11 @@ func convertJournalsToAccountTransactions(journals []models.Journal) ([]models.A
 	for _, journal := range journals {
 		for _, journalLine := range journal.JournalLines {
 			if journalLine.AccountType == "REVENUE" || journalLine.AccountType == "EXPENSE" || journalLine.AccountType == "OVERHEADS" || journalLine.AccountType == "OTHERINCOME" || journalLine.AccountType == "DIRECTCOSTS" {
-				dateStr := journal.JournalDate
-				re := regexp.MustCompile(`/Date\((\d+)\+\d+\)/`)
-				dateSplit := re.FindStringSubmatch(dateStr)
-				var date time.Time
-				if len(dateSplit) > 1 {
-					dateUnix, err := strconv.Atoi(dateSplit[1])
-					if err != nil {
-						return nil, err
-					}
-					date = time.Unix(int64(dateUnix/1000), 0)
-				} else {
+				date, err := parseXeroDate(journal.JournalDate)
+				if err != nil {
+					return nil, err
+				}
+				if date.IsZero() {
 					date = time.Now()
 				}
 				accountTransaction := models.AccountTransaction{
@@ -51,6 +47,14 @@ func convertJournalsToAccountTransactions(journals []models.Journal) ([]models.A
 					Amount:        math.Abs(journalLine.GrossAmount),
 					Reference:     journal.Reference,
 					Description:   journalLine.Description,
+					SourceID:      journal.SourceID,
+					GrossAmount:   journalLine.GrossAmount,
+					NetAmount:     journalLine.NetAmount,
+					TaxAmount:     journalLine.TaxAmount,
+					TaxType:       journalLine.TaxType,
+					SourceType:    journal.SourceType,
+					Origin:        journalsEndpoint,
+					Tracking:      journalLine.TrackingCategories,
 				}
 				accountTransactions = append(accountTransactions, accountTransaction)
 			}
@@ -59,6 +63,10 @@ func convertJournalsToAccountTransactions(journals []models.Journal) ([]models.A
 	return accountTransactions, nil
 }
 
+// convertTransactionsToAccountTransactions returns one row per line item, so
+// that a split bank transaction is booked to each of its accounts. Rows are
+// identified by their LineItemID, and bank transactions without line items
+// are skipped.
 func convertTransactionsToAccountTransactions(transactions []models.XeroTransaction) ([]models.AccountTransaction, error) {
 	accountTransactions := []models.AccountTransaction{}
 	for _, transaction := range transactions {
@@ -66,25 +74,70 @@ func convertTransactionsToAccountTransactions(transactions []models.XeroTransact
 		if err != nil {
 			return nil, err
 		}
-		accountTransaction := models.AccountTransaction{
-			TransactionID: transaction.BankTransactionID,
-			AccountCode:   transaction.LineItems[0].AccountCode,
-			Date:          date,
-			Amount:        math.Abs(transaction.Total),
-			Reference:     transaction.Reference,
-			Description:   transaction.LineItems[0].Description,
+		for i, lineItem := range transaction.LineItems {
+			lineID := lineItem.LineItemID
+			if lineID == "" {
+				lineID = fmt.Sprintf("%s-%d", transaction.BankTransactionID, i)
+			}
+			// Amounts are signed like journal lines: debits are positive. The
+			// line's account is credited when money is received.
+			sign := 1.0
+			if bankTransactionSourceType(transaction.Type) == bankTransactionTypeReceive {
+				sign = -1
+			}
+			netAmount := lineItem.LineAmount
+			if transaction.LineAmountTypes == "Inclusive" {
+				netAmount -= lineItem.TaxAmount
+			}
+			netAmount *= sign
+			taxAmount := lineItem.TaxAmount * sign
+			accountTransaction := models.AccountTransaction{
+				TransactionID: lineID,
+				AccountCode:   lineItem.AccountCode,
+				Date:          date,
+				Amount:        math.Abs(netAmount + taxAmount),
+				GrossAmount:   netAmount + taxAmount,
+				NetAmount:     netAmount,
+				TaxAmount:     taxAmount,
+				TaxType:       lineItem.TaxType,
+				Reference:     transaction.Reference,
+				Description:   lineItem.Description,
+				CurrencyCode:  transaction.CurrencyCode,
+				CurrencyRate:  transaction.CurrencyRate,
+				ContactID:     transaction.Contact.ContactID,
+				SourceID:      transaction.BankTransactionID,
+				SourceType:    bankTransactionSourceType(transaction.Type),
+				Origin:        bankTransactionsEndpoint,
+				Tracking:      lineItem.Tracking,
+				Deleted:       transaction.Status == "DELETED",
+			}
+			accountTransactions = append(accountTransactions, accountTransaction)
 		}
-		accountTransactions = append(accountTransactions, accountTransaction)
 	}
 	return accountTransactions, nil
 }
 
-func filterBankAccountTransactions(transactions []models.AccountTransaction) ([]models.AccountTransaction, error) {
+func filterBankAccountTransactions(transactions []models.AccountTransaction, excludedAccountCodes []string) ([]models.AccountTransaction, error) {
 	filteredTransactions := []models.AccountTransaction{}
 	for _, transaction := range transactions {
-		if transaction.AccountCode != "7003" {
+		if !slices.Contains(excludedAccountCodes, transaction.AccountCode) {
 			filteredTransactions = append(filteredTransactions, transaction)
 		}
 	}
 	return filteredTransactions, nil
 }
+
+// SourceTypes of the journals Xero writes for bank transactions.
+const (
+	bankTransactionTypeReceive = "CASHREC"
+	bankTransactionTypeSpend   = "CASHPAID"
+)
+
+// bankTransactionSourceType returns the SourceType Xero gives the journals of
+// a bank transaction of the given type, so both kinds of row can be compared.
+func bankTransactionSourceType(transactionType string) string {
+	if strings.HasPrefix(transactionType, "RECEIVE") {
+		return bankTransactionTypeReceive
+	}
+	return bankTransactionTypeSpend
+}
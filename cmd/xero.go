@@ -3,9 +3,9 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net/http"
 	"net/url"
 	"time"
@@ -14,166 +14,277 @@ import (
 	"golang.org/x/oauth2"
 )
 
-func getAllTransactions(token *oauth2.Token, tenantID string) ([]models.XeroTransaction, error) {
-	transactions := []models.XeroTransaction{}
+// getAllPages calls fetch for page after page until Xero returns a short
+// one, passing the items decoded from each page to handle as it arrives. The
+// next page is not fetched until handle returns, so a slow consumer slows the
+// fetch down rather than letting pages pile up in memory.
+func getAllPages[T any](ctx context.Context, report progressFunc, tenantID string, endpoint string, fetch func(page int) ([]byte, error), decode func([]byte) ([]T, error), handle func([]T) error) error {
+	fetched := 0
 	page := 1
 	for {
-		transaction := models.TransactionBody{}
-		transactionBytes, err := getTransactions(token, page, tenantID)
+		body, err := fetch(page)
 		if err != nil {
-			fmt.Println("Error getting invoices", err)
-			log.Fatal(err)
+			return atPage(err, page)
 		}
-		err = json.Unmarshal(transactionBytes, &transaction)
+		items, err := decode(body)
 		if err != nil {
-			fmt.Println("Error unmarshalling", err)
-			log.Fatal(err)
+			return &xeroError{Kind: errDecode, TenantID: tenantID, Endpoint: endpoint, Page: page, Err: err}
 		}
-		transactions = append(transactions, transaction.BankTransactions...)
-		if len(transaction.BankTransactions) < 100 {
+		fetched += len(items)
+		report.send(models.JobEvent{Type: "page", Endpoint: endpoint, Page: page, Rows: fetched})
+		err = handle(items)
+		if err != nil {
+			return err
+		}
+		if len(items) < 100 {
 			break
 		}
 		page++
-		if page%20 == 0 {
-			time.Sleep(60 * time.Second)
-		}
 	}
-	return transactions, nil
+	return nil
 }
 
-func getTransactions(token *oauth2.Token, page int, tenantID string) ([]byte, error) {
-	req, err := http.NewRequest("GET", "https://api.xero.com/api.xro/2.0/BankTransactions", nil)
-	if err != nil {
-		return nil, err
+func getAllTransactions(ctx context.Context, report progressFunc, tokenSource oauth2.TokenSource, tenantID string, modifiedSince time.Time, handle func([]models.XeroTransaction) error) error {
+	fetch := func(page int) ([]byte, error) {
+		return getTransactions(ctx, tokenSource, page, tenantID, modifiedSince)
+	}
+	decode := func(body []byte) ([]models.XeroTransaction, error) {
+		transactions := models.TransactionBody{}
+		err := json.Unmarshal(body, &transactions)
+		return transactions.BankTransactions, err
 	}
+	return getAllPages(ctx, report, tenantID, bankTransactionsEndpoint, fetch, decode, handle)
+}
+
+func getTransactions(ctx context.Context, tokenSource oauth2.TokenSource, page int, tenantID string, modifiedSince time.Time) ([]byte, error) {
 	params := url.Values{}
 	params.Add("page", fmt.Sprintf("%d", page))
-	params.Add("where", "Status!=\"DELETED\"")
-	req.URL.RawQuery = params.Encode()
-	req.Header.Add("xero-tenant-id", tenantID)
-	req.Header.Add("Accept", "application/json")
-	client := oauth2Config.Client(context.Background(), token)
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, err
+	// Incremental runs need deleted transactions so they can be flagged in
+	// BigQuery; a full run flags them by their absence instead.
+	if modifiedSince.IsZero() {
+		params.Add("where", "Status!=\"DELETED\"")
+	}
+	return xeroGet(ctx, tokenSource, tenantID, bankTransactionsEndpoint, params, modifiedSince)
+}
+
+func getAllInvoices(ctx context.Context, report progressFunc, tokenSource oauth2.TokenSource, tenantID string, modifiedSince time.Time, handle func([]models.XeroInvoice) error) error {
+	fetch := func(page int) ([]byte, error) {
+		return getPagedDocuments(ctx, tokenSource, invoicesEndpoint, page, tenantID, modifiedSince)
+	}
+	decode := func(body []byte) ([]models.XeroInvoice, error) {
+		invoices := models.InvoicesResponse{}
+		err := json.Unmarshal(body, &invoices)
+		return invoices.Invoices, err
+	}
+	return getAllPages(ctx, report, tenantID, invoicesEndpoint, fetch, decode, handle)
+}
+
+func getAllCreditNotes(ctx context.Context, report progressFunc, tokenSource oauth2.TokenSource, tenantID string, modifiedSince time.Time, handle func([]models.XeroCreditNote) error) error {
+	fetch := func(page int) ([]byte, error) {
+		return getPagedDocuments(ctx, tokenSource, creditNotesEndpoint, page, tenantID, modifiedSince)
+	}
+	decode := func(body []byte) ([]models.XeroCreditNote, error) {
+		creditNotes := models.CreditNotesResponse{}
+		err := json.Unmarshal(body, &creditNotes)
+		return creditNotes.CreditNotes, err
+	}
+	return getAllPages(ctx, report, tenantID, creditNotesEndpoint, fetch, decode, handle)
+}
+
+func getAllPayments(ctx context.Context, report progressFunc, tokenSource oauth2.TokenSource, tenantID string, modifiedSince time.Time, handle func([]models.XeroPayment) error) error {
+	fetch := func(page int) ([]byte, error) {
+		return getPagedDocuments(ctx, tokenSource, paymentsEndpoint, page, tenantID, modifiedSince)
 	}
-	defer resp.Body.Close()
-	body, err := io.ReadAll(resp.Body)
+	decode := func(body []byte) ([]models.XeroPayment, error) {
+		payments := models.PaymentsResponse{}
+		err := json.Unmarshal(body, &payments)
+		return payments.Payments, err
+	}
+	return getAllPages(ctx, report, tenantID, paymentsEndpoint, fetch, decode, handle)
+}
+
+func getAllOverpayments(ctx context.Context, report progressFunc, tokenSource oauth2.TokenSource, tenantID string, modifiedSince time.Time, handle func([]models.XeroOverpayment) error) error {
+	fetch := func(page int) ([]byte, error) {
+		return getPagedDocuments(ctx, tokenSource, overpaymentsEndpoint, page, tenantID, modifiedSince)
+	}
+	decode := func(body []byte) ([]models.XeroOverpayment, error) {
+		overpayments := models.OverpaymentsResponse{}
+		err := json.Unmarshal(body, &overpayments)
+		return overpayments.Overpayments, err
+	}
+	return getAllPages(ctx, report, tenantID, overpaymentsEndpoint, fetch, decode, handle)
+}
+
+func getAllPrepayments(ctx context.Context, report progressFunc, tokenSource oauth2.TokenSource, tenantID string, modifiedSince time.Time, handle func([]models.XeroPrepayment) error) error {
+	fetch := func(page int) ([]byte, error) {
+		return getPagedDocuments(ctx, tokenSource, prepaymentsEndpoint, page, tenantID, modifiedSince)
+	}
+	decode := func(body []byte) ([]models.XeroPrepayment, error) {
+		prepayments := models.PrepaymentsResponse{}
+		err := json.Unmarshal(body, &prepayments)
+		return prepayments.Prepayments, err
+	}
+	return getAllPages(ctx, report, tenantID, prepaymentsEndpoint, fetch, decode, handle)
+}
+
+// getAllContacts fetches contacts including archived ones, so that their
+// status is kept up to date in BigQuery.
+func getAllContacts(ctx context.Context, report progressFunc, tokenSource oauth2.TokenSource, tenantID string, modifiedSince time.Time, handle func([]models.Contact) error) error {
+	fetch := func(page int) ([]byte, error) {
+		params := url.Values{}
+		params.Add("page", fmt.Sprintf("%d", page))
+		params.Add("includeArchived", "true")
+		return xeroGet(ctx, tokenSource, tenantID, contactsEndpoint, params, modifiedSince)
+	}
+	decode := func(body []byte) ([]models.Contact, error) {
+		contacts := models.ContactsResponse{}
+		err := json.Unmarshal(body, &contacts)
+		return contacts.Contacts, err
+	}
+	return getAllPages(ctx, report, tenantID, contactsEndpoint, fetch, decode, handle)
+}
+
+// getAllTrackingCategories fetches every tracking category with its
+// options, including archived ones. The endpoint is neither paged nor
+// filtered by modification time, so it is always fetched in full.
+func getAllTrackingCategories(ctx context.Context, report progressFunc, tokenSource oauth2.TokenSource, tenantID string, modifiedSince time.Time, handle func([]models.TrackingCategory) error) error {
+	params := url.Values{}
+	params.Add("includeArchived", "true")
+	body, err := xeroGet(ctx, tokenSource, tenantID, trackingEndpoint, params, time.Time{})
 	if err != nil {
-		return nil, err
+		return err
 	}
-	if resp.StatusCode != http.StatusOK {
-		fmt.Printf("body: %s\n", body)
-		return nil, fmt.Errorf("unexpected status: %s", resp.Status)
+	categories := models.TrackingCategoriesResponse{}
+	err = json.Unmarshal(body, &categories)
+	if err != nil {
+		return &xeroError{Kind: errDecode, TenantID: tenantID, Endpoint: trackingEndpoint, Err: err}
 	}
+	report.send(models.JobEvent{Type: "page", Endpoint: trackingEndpoint, Page: 1, Rows: len(categories.TrackingCategories)})
+	return handle(categories.TrackingCategories)
+}
 
-	return body, nil
+// getPagedDocuments fetches one page of an endpoint such as Invoices that
+// includes line items when it is paged. Every status is requested, so voided
+// and deleted documents are updated in BigQuery too.
+func getPagedDocuments(ctx context.Context, tokenSource oauth2.TokenSource, endpoint string, page int, tenantID string, modifiedSince time.Time) ([]byte, error) {
+	params := url.Values{}
+	params.Add("page", fmt.Sprintf("%d", page))
+	return xeroGet(ctx, tokenSource, tenantID, endpoint, params, modifiedSince)
 }
 
-func getAllJournals(token *oauth2.Token, tenantID string) ([]models.Journal, error) {
-	journals := []models.Journal{}
-	offset := 0
+// getAllJournals pages through every journal with a JournalNumber greater
+// than offset, passing each page to handle as it arrives. Passing the last
+// journal number seen resumes a previous import; a non-zero modifiedSince
+// limits it to journals created after that time.
+func getAllJournals(ctx context.Context, report progressFunc, tokenSource oauth2.TokenSource, tenantID string, offset int, modifiedSince time.Time, handle func([]models.Journal) error) error {
+	fetched := 0
+	page := 1
 	for {
 		journal := models.JournalsResponse{}
-		journalBytes, err := getJournals(token, offset, tenantID)
+		journalBytes, err := getJournals(ctx, tokenSource, offset, tenantID, modifiedSince)
 		if err != nil {
-			fmt.Println("Error getting invoices", err)
-			log.Fatal(err)
+			return atPage(err, page)
 		}
 		err = json.Unmarshal(journalBytes, &journal)
 		if err != nil {
-			fmt.Println("Error unmarshalling", err)
-			log.Fatal(err)
+			return &xeroError{Kind: errDecode, TenantID: tenantID, Endpoint: journalsEndpoint, Page: page, Err: err}
+		}
+		fetched += len(journal.Journals)
+		report.send(models.JobEvent{Type: "page", Endpoint: journalsEndpoint, Page: page, Rows: fetched})
+		err = handle(journal.Journals)
+		if err != nil {
+			return err
 		}
-		journals = append(journals, journal.Journals...)
 		if len(journal.Journals) < 100 {
 			break
 		}
-		offset += 100
-		if offset%2000 == 0 {
-			time.Sleep(60 * time.Second)
-		}
+		offset = latestJournalNumber(journal.Journals, offset)
+		page++
 	}
-	return journals, nil
+	return nil
 }
 
-func getJournals(token *oauth2.Token, offset int, tenantID string) ([]byte, error) {
-	req, err := http.NewRequest("GET", "https://api.xero.com/api.xro/2.0/Journals", nil)
-	if err != nil {
-		return nil, err
-	}
+func getJournals(ctx context.Context, tokenSource oauth2.TokenSource, offset int, tenantID string, modifiedSince time.Time) ([]byte, error) {
 	params := url.Values{}
 	params.Add("offset", fmt.Sprintf("%d", offset))
-	req.URL.RawQuery = params.Encode()
-	req.Header.Add("xero-tenant-id", tenantID)
-	req.Header.Add("Accept", "application/json")
-	client := oauth2Config.Client(context.Background(), token)
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-	body, err := io.ReadAll(resp.Body)
+	return xeroGet(ctx, tokenSource, tenantID, journalsEndpoint, params, modifiedSince)
+}
+
+// xeroGet fetches an Accounting API endpoint for a tenant, retrying failures
+// that are likely to be transient. Calls are paced by the tenant's rate
+// limiter. Errors are returned as *xeroError.
+func xeroGet(ctx context.Context, tokenSource oauth2.TokenSource, tenantID string, endpoint string, params url.Values, modifiedSince time.Time) ([]byte, error) {
+	var body []byte
+	limiter := tenantRateLimiter(tenantID)
+	err := withRetry(ctx, func() error {
+		req, err := http.NewRequestWithContext(ctx, "GET", "https://api.xero.com/api.xro/2.0/"+endpoint, nil)
+		if err != nil {
+			return err
+		}
+		req.URL.RawQuery = params.Encode()
+		req.Header.Add("xero-tenant-id", tenantID)
+		req.Header.Add("Accept", "application/json")
+		if !modifiedSince.IsZero() {
+			req.Header.Add("If-Modified-Since", modifiedSince.UTC().Format("2006-01-02T15:04:05"))
+		}
+		release, err := limiter.acquire(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return &xeroError{Kind: errRateLimited, TenantID: tenantID, Endpoint: endpoint, RetryAfter: limiter.blockedFor(), Err: err}
+		}
+		defer release()
+		client := oauth2.NewClient(ctx, tokenSource)
+		resp, err := client.Do(req)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			kind := errNetwork
+			var retrieveErr *oauth2.RetrieveError
+			if errors.As(err, &retrieveErr) {
+				kind = errUnauthorized
+			}
+			return &xeroError{Kind: kind, TenantID: tenantID, Endpoint: endpoint, Err: err}
+		}
+		defer resp.Body.Close()
+		limiter.observe(resp, tenantID)
+		body, err = io.ReadAll(resp.Body)
+		if err != nil {
+			return &xeroError{Kind: errNetwork, TenantID: tenantID, Endpoint: endpoint, Err: err}
+		}
+		if resp.StatusCode != http.StatusOK {
+			return statusError(resp, body, tenantID, endpoint)
+		}
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
-	if resp.StatusCode != http.StatusOK {
-		fmt.Printf("body: %s\n", body)
-		return nil, fmt.Errorf("unexpected status: %s", resp.Status)
-	}
 	return body, nil
 }
 
-func modifyAccountLookupTable(accountLookup map[string]models.AccountLookup) map[string]models.AccountLookup {
-	delete(accountLookup, "9310")
-	delete(accountLookup, "6005")
-	replaceLookup := map[string]string{
-		"4103": "4201",
-		"4106": "4105",
-		"4200": "4100",
-		"4202": "4102",
-		"4207": "4206",
-		"4906": "4206",
-		"4907": "4201",
-		"4908": "4102",
-		"4909": "4101",
-		"4915": "4102",
-		"4916": "4102",
-		"4917": "4201",
-		"4918": "4100",
-		"4923": "4102",
-		"4924": "4206",
-		"4925": "4206",
-		"4926": "4206",
-		"7007": "8204",
-		"7303": "8204",
-		"7399": "7400",
-		"7401": "7304",
-		"7402": "7304",
-		"8209": "8213",
-		"8214": "8213",
-		"9000": "7003",
-		"9100": "7003",
-		"9200": "7003",
-		"9300": "7003",
-		"9505": "4100",
-		"9506": "4105",
-		"9509": "4100",
-		"477":  "7003",
-		"478":  "7003",
-	}
-	for key, value := range replaceLookup {
-		tempAccount := models.AccountLookup{
-			Name:  accountLookup[value].Name,
-			Group: accountLookup[value].Group,
-		}
-		accountLookup[key] = tempAccount
+// getBaseCurrency returns the currency the organisation reports in, which is
+// also the currency of its journals.
+func getBaseCurrency(ctx context.Context, tokenSource oauth2.TokenSource, tenantID string) (string, error) {
+	body, err := xeroGet(ctx, tokenSource, tenantID, "Organisation", url.Values{}, time.Time{})
+	if err != nil {
+		return "", err
+	}
+	organisations := models.OrganisationsResponse{}
+	err = json.Unmarshal(body, &organisations)
+	if err != nil {
+		return "", &xeroError{Kind: errDecode, TenantID: tenantID, Endpoint: "Organisation", Err: err}
+	}
+	if len(organisations.Organisations) == 0 || organisations.Organisations[0].BaseCurrency == "" {
+		return "", &xeroError{Kind: errDecode, TenantID: tenantID, Endpoint: "Organisation", Err: errors.New("no base currency")}
 	}
-	return accountLookup
+	return organisations.Organisations[0].BaseCurrency, nil
 }
 
-func getAccountLookupTable(token *oauth2.Token, tenantID string) (map[string]models.AccountLookup, error) {
-	accounts, err := getAccounts(token, tenantID)
+func getAccountLookupTable(ctx context.Context, tokenSource oauth2.TokenSource, tenantID string) (map[string]models.AccountLookup, error) {
+	accounts, err := getAccounts(ctx, tokenSource, tenantID)
 	if err != nil {
 		return nil, err
 	}
@@ -188,34 +299,17 @@ func getAccountLookupTable(token *oauth2.Token, tenantID string) (map[string]mod
 	return accountLookup, nil
 }
 
-func getAccounts(token *oauth2.Token, tenantID string) (models.AccountBody, error) {
+func getAccounts(ctx context.Context, tokenSource oauth2.TokenSource, tenantID string) (models.AccountBody, error) {
 	accounts := models.AccountBody{}
-	req, err := http.NewRequest("GET", "https://api.xero.com/api.xro/2.0/Accounts", nil)
-	if err != nil {
-		return accounts, err
-	}
 	params := url.Values{}
 	params.Add("where", "Type==\"REVENUE\"||Type==\"EXPENSE\"||Type==\"OVERHEADS\"||Type==\"OTHERINCOME\"||Type==\"DIRECTCOSTS\"")
-	req.URL.RawQuery = params.Encode()
-	req.Header.Add("xero-tenant-id", tenantID)
-	req.Header.Add("Accept", "application/json")
-	client := oauth2Config.Client(context.Background(), token)
-	resp, err := client.Do(req)
+	body, err := xeroGet(ctx, tokenSource, tenantID, "Accounts", params, time.Time{})
 	if err != nil {
 		return accounts, err
 	}
-	defer resp.Body.Close()
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return accounts, err
-	}
-	if resp.StatusCode != http.StatusOK {
-		fmt.Printf("body: %s\n", body)
-		return accounts, fmt.Errorf("unexpected status: %s", resp.Status)
-	}
 	err = json.Unmarshal(body, &accounts)
 	if err != nil {
-		return accounts, err
+		return accounts, &xeroError{Kind: errDecode, TenantID: tenantID, Endpoint: "Accounts", Err: err}
 	}
 
 	return accounts, nil
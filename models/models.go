@@ -3,20 +3,128 @@ package models
 import (
 	"time"
 
+	"cloud.google.com/go/bigquery"
 	"golang.org/x/oauth2"
 )
 
 type App struct {
-	Oauth2Token *oauth2.Token
+	TokenSource oauth2.TokenSource
 }
 
 type XeroCompany struct {
-	ID      string
-	Company string
+	ID                   string   `json:"tenant_id"`
+	Company              string   `json:"company"`
+	Name                 string   `json:"name,omitempty"`
+	Enabled              bool     `json:"enabled"`
+	ExcludedAccountCodes []string `json:"excluded_account_codes,omitempty"`
+	BQDataset            string   `json:"bq_dataset,omitempty"`
+	BQTable              string   `json:"bq_table,omitempty"`
+	Schedules            []string `json:"schedules,omitempty"`
+}
+
+type BQDestination struct {
+	ProjectID string
+	DatasetID string
+	TableID   string
+}
+
+type SchemaDiff struct {
+	Table       string   `json:"table"`
+	Added       []string `json:"added,omitempty"`
+	Removed     []string `json:"removed,omitempty"`
+	Destructive []string `json:"destructive,omitempty"`
+}
+
+type TenantConfig struct {
+	Tenants []XeroCompany `json:"tenants"`
+}
+
+type XeroConnection struct {
+	ID         string `json:"id"`
+	TenantID   string `json:"tenantId"`
+	TenantType string `json:"tenantType"`
+	TenantName string `json:"tenantName"`
 }
 
 type PageData struct {
-	TokenSet bool
+	TokenSet      bool
+	Tenants       []XeroCompany
+	ScheduledRuns []ScheduledRun
+	NextRuns      []ScheduledRun
+}
+
+type ScheduledRun struct {
+	Tenant   string
+	Schedule string
+	Due      time.Time
+	Started  time.Time
+	Finished time.Time
+	Status   string
+	Message  string
+}
+
+type ImportOptions struct {
+	Tenants    []string
+	Since      time.Time
+	DryRun     bool
+	PreviewCSV string
+}
+
+type Job struct {
+	ID       string    `json:"id"`
+	Status   string    `json:"status"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished,omitempty"`
+	Message  string    `json:"message,omitempty"`
+}
+
+type JobEvent struct {
+	Type     string            `json:"type"`
+	Time     time.Time         `json:"time"`
+	Tenant   string            `json:"tenant,omitempty"`
+	Endpoint string            `json:"endpoint,omitempty"`
+	Page     int               `json:"page,omitempty"`
+	Batch    int               `json:"batch,omitempty"`
+	Rows     int               `json:"rows,omitempty"`
+	Message  string            `json:"message,omitempty"`
+	Unmapped []UnmappedAccount `json:"unmapped,omitempty"`
+	Preview  *DryRunPreview    `json:"preview,omitempty"`
+	Schema   *SchemaDiff       `json:"schema,omitempty"`
+}
+
+type DryRunPreview struct {
+	Rows   int             `json:"rows"`
+	Groups []PreviewGroup  `json:"groups"`
+	Sample []BQTransaction `json:"sample"`
+}
+
+type PreviewGroup struct {
+	Company     string  `json:"company"`
+	Group       string  `json:"group"`
+	RevenueLine string  `json:"revenue_line"`
+	Rows        int     `json:"rows"`
+	Amount      float64 `json:"amount"`
+	Currency    string  `json:"currency"`
+}
+
+type UnmappedAccount struct {
+	AccountCode string   `json:"account_code"`
+	Rows        int      `json:"rows"`
+	Amount      float64  `json:"amount"`
+	SampleIDs   []string `json:"sample_ids"`
+}
+
+type BQException struct {
+	RunID        string    `bigquery:"run_id"`
+	RunAt        time.Time `bigquery:"run_at"`
+	Company      string    `bigquery:"company"`
+	Kind         string    `bigquery:"kind"`
+	CurrencyPair string    `bigquery:"currency_pair"`
+	AccountCode  string    `bigquery:"account_code"`
+	Rows         int       `bigquery:"rows"`
+	Amount       float64   `bigquery:"amount"`
+	SampleIDs    []string  `bigquery:"sample_ids"`
+	RowIDs       []string  `bigquery:"row_ids"`
 }
 
 type TransactionBody struct {
@@ -45,6 +153,7 @@ type XeroTransaction struct {
 	Total             float64     `json:"Total"`
 	UpdatedDateUTC    string      `json:"UpdatedDateUTC"`
 	CurrencyCode      string      `json:"CurrencyCode"`
+	CurrencyRate      float64     `json:"CurrencyRate"`
 }
 
 type BankAccount struct {
@@ -54,38 +163,352 @@ type BankAccount struct {
 }
 
 type Contact struct {
-	ContactID           string `json:"ContactID"`
-	Name                string `json:"Name"`
-	Addresses           []any  `json:"Addresses"`
-	Phones              []any  `json:"Phones"`
-	ContactGroups       []any  `json:"ContactGroups"`
-	ContactPersons      []any  `json:"ContactPersons"`
-	HasValidationErrors bool   `json:"HasValidationErrors"`
+	ContactID           string         `json:"ContactID"`
+	Name                string         `json:"Name"`
+	EmailAddress        string         `json:"EmailAddress"`
+	ContactStatus       string         `json:"ContactStatus"`
+	IsSupplier          bool           `json:"IsSupplier"`
+	IsCustomer          bool           `json:"IsCustomer"`
+	DefaultCurrency     string         `json:"DefaultCurrency"`
+	Addresses           []any          `json:"Addresses"`
+	Phones              []any          `json:"Phones"`
+	ContactGroups       []ContactGroup `json:"ContactGroups"`
+	ContactPersons      []any          `json:"ContactPersons"`
+	HasValidationErrors bool           `json:"HasValidationErrors"`
+	UpdatedDateUTC      string         `json:"UpdatedDateUTC"`
+}
+
+type ContactGroup struct {
+	ContactGroupID string `json:"ContactGroupID"`
+	Name           string `json:"Name"`
+	Status         string `json:"Status"`
+}
+
+type ContactsResponse struct {
+	Contacts []Contact `json:"Contacts"`
 }
 
 type LineItem struct {
-	Description string  `json:"Description"`
-	UnitAmount  float64 `json:"UnitAmount"`
-	TaxType     string  `json:"TaxType"`
-	TaxAmount   float64 `json:"TaxAmount"`
-	LineAmount  float64 `json:"LineAmount"`
-	AccountCode string  `json:"AccountCode"`
-	Tracking    []any   `json:"Tracking"`
-	Quantity    float64 `json:"Quantity"`
-	LineItemID  string  `json:"LineItemID"`
-	AccountID   string  `json:"AccountID"`
+	Description string         `json:"Description"`
+	UnitAmount  float64        `json:"UnitAmount"`
+	TaxType     string         `json:"TaxType"`
+	TaxAmount   float64        `json:"TaxAmount"`
+	LineAmount  float64        `json:"LineAmount"`
+	AccountCode string         `json:"AccountCode"`
+	Tracking    []TrackingItem `json:"Tracking"`
+	Quantity    float64        `json:"Quantity"`
+	LineItemID  string         `json:"LineItemID"`
+	AccountID   string         `json:"AccountID"`
 }
 
+// BQTransaction amounts are signed with debits positive, except Amount, which
+// is the unsigned gross amount that existing reports are built on. Amounts are
+// in CurrencyCode apart from ReportingAmount. Totals should leave out rows
+// that are Deleted in Xero and bank transaction rows Superseded by the
+// journal line in DuplicateOf.
 type BQTransaction struct {
-	TransactionID string    `bigquery:"id"`
-	Company       string    `bigquery:"company"`
-	Date          time.Time `bigquery:"date"`
+	TransactionID     string               `bigquery:"id"`
+	Company           string               `bigquery:"company"`
+	Date              time.Time            `bigquery:"date"`
+	Amount            float64              `bigquery:"amount"`
+	Reference         string               `bigquery:"reference"`
+	RevenueLine       string               `bigquery:"revenue_line"`
+	Description       string               `bigquery:"description"`
+	Group             string               `bigquery:"transfer_group"`
+	AccountCode       string               `bigquery:"account_code"`
+	Debit             float64              `bigquery:"debit"`
+	Credit            float64              `bigquery:"credit"`
+	NetAmount         float64              `bigquery:"net_amount"`
+	TaxAmount         float64              `bigquery:"tax_amount"`
+	TaxType           string               `bigquery:"tax_type"`
+	GrossAmount       float64              `bigquery:"gross_amount"`
+	CurrencyCode      string               `bigquery:"currency_code"`
+	OriginalAmount    float64              `bigquery:"original_amount"`
+	CurrencyRate      float64              `bigquery:"currency_rate"`
+	ReportingCurrency string               `bigquery:"reporting_currency"`
+	ReportingAmount   bigquery.NullFloat64 `bigquery:"reporting_amount"`
+	ContactID         string               `bigquery:"contact_id"`
+	SourceID          string               `bigquery:"source_id"`
+	SourceType        string               `bigquery:"source_type"`
+	Origin            string               `bigquery:"origin"`
+	DuplicateOf       string               `bigquery:"duplicate_of"`
+	Superseded        bool                 `bigquery:"superseded"`
+	Tracking          []BQTracking         `bigquery:"tracking"`
+	Deleted           bool                 `bigquery:"deleted"`
+}
+
+type BQTracking struct {
+	CategoryID string `bigquery:"category_id"`
+	Category   string `bigquery:"category"`
+	OptionID   string `bigquery:"option_id"`
+	Option     string `bigquery:"option"`
+}
+
+type InvoicesResponse struct {
+	Invoices []XeroInvoice `json:"Invoices"`
+}
+
+type XeroInvoice struct {
+	InvoiceID       string     `json:"InvoiceID"`
+	InvoiceNumber   string     `json:"InvoiceNumber"`
+	Type            string     `json:"Type"`
+	Reference       string     `json:"Reference"`
+	Contact         Contact    `json:"Contact"`
+	DateString      string     `json:"DateString"`
+	DueDateString   string     `json:"DueDateString"`
+	Status          string     `json:"Status"`
+	LineAmountTypes string     `json:"LineAmountTypes"`
+	LineItems       []LineItem `json:"LineItems"`
+	SubTotal        float64    `json:"SubTotal"`
+	TotalTax        float64    `json:"TotalTax"`
+	Total           float64    `json:"Total"`
+	AmountDue       float64    `json:"AmountDue"`
+	AmountPaid      float64    `json:"AmountPaid"`
+	AmountCredited  float64    `json:"AmountCredited"`
+	CurrencyCode    string     `json:"CurrencyCode"`
+	UpdatedDateUTC  string     `json:"UpdatedDateUTC"`
+}
+
+type CreditNotesResponse struct {
+	CreditNotes []XeroCreditNote `json:"CreditNotes"`
+}
+
+type XeroCreditNote struct {
+	CreditNoteID     string     `json:"CreditNoteID"`
+	CreditNoteNumber string     `json:"CreditNoteNumber"`
+	Type             string     `json:"Type"`
+	Reference        string     `json:"Reference"`
+	Contact          Contact    `json:"Contact"`
+	DateString       string     `json:"DateString"`
+	DueDateString    string     `json:"DueDateString"`
+	Status           string     `json:"Status"`
+	LineAmountTypes  string     `json:"LineAmountTypes"`
+	LineItems        []LineItem `json:"LineItems"`
+	SubTotal         float64    `json:"SubTotal"`
+	TotalTax         float64    `json:"TotalTax"`
+	Total            float64    `json:"Total"`
+	RemainingCredit  float64    `json:"RemainingCredit"`
+	AppliedAmount    float64    `json:"AppliedAmount"`
+	CurrencyCode     string     `json:"CurrencyCode"`
+	UpdatedDateUTC   string     `json:"UpdatedDateUTC"`
+}
+
+type PaymentsResponse struct {
+	Payments []XeroPayment `json:"Payments"`
+}
+
+type XeroPayment struct {
+	PaymentID      string          `json:"PaymentID"`
+	Date           string          `json:"Date"`
+	Amount         float64         `json:"Amount"`
+	BankAmount     float64         `json:"BankAmount"`
+	CurrencyRate   float64         `json:"CurrencyRate"`
+	Reference      string          `json:"Reference"`
+	PaymentType    string          `json:"PaymentType"`
+	Status         string          `json:"Status"`
+	IsReconciled   bool            `json:"IsReconciled"`
+	Account        BankAccount     `json:"Account"`
+	Invoice        XeroInvoice     `json:"Invoice"`
+	CreditNote     XeroCreditNote  `json:"CreditNote"`
+	Prepayment     XeroPrepayment  `json:"Prepayment"`
+	Overpayment    XeroOverpayment `json:"Overpayment"`
+	UpdatedDateUTC string          `json:"UpdatedDateUTC"`
+}
+
+type OverpaymentsResponse struct {
+	Overpayments []XeroOverpayment `json:"Overpayments"`
+}
+
+type XeroOverpayment struct {
+	OverpaymentID   string       `json:"OverpaymentID"`
+	Type            string       `json:"Type"`
+	Contact         Contact      `json:"Contact"`
+	DateString      string       `json:"DateString"`
+	Status          string       `json:"Status"`
+	LineAmountTypes string       `json:"LineAmountTypes"`
+	LineItems       []LineItem   `json:"LineItems"`
+	SubTotal        float64      `json:"SubTotal"`
+	TotalTax        float64      `json:"TotalTax"`
+	Total           float64      `json:"Total"`
+	RemainingCredit float64      `json:"RemainingCredit"`
+	Allocations     []Allocation `json:"Allocations"`
+	CurrencyCode    string       `json:"CurrencyCode"`
+	UpdatedDateUTC  string       `json:"UpdatedDateUTC"`
+}
+
+type PrepaymentsResponse struct {
+	Prepayments []XeroPrepayment `json:"Prepayments"`
+}
+
+type XeroPrepayment struct {
+	PrepaymentID    string       `json:"PrepaymentID"`
+	Type            string       `json:"Type"`
+	Reference       string       `json:"Reference"`
+	Contact         Contact      `json:"Contact"`
+	DateString      string       `json:"DateString"`
+	Status          string       `json:"Status"`
+	LineAmountTypes string       `json:"LineAmountTypes"`
+	LineItems       []LineItem   `json:"LineItems"`
+	SubTotal        float64      `json:"SubTotal"`
+	TotalTax        float64      `json:"TotalTax"`
+	Total           float64      `json:"Total"`
+	RemainingCredit float64      `json:"RemainingCredit"`
+	Allocations     []Allocation `json:"Allocations"`
+	CurrencyCode    string       `json:"CurrencyCode"`
+	UpdatedDateUTC  string       `json:"UpdatedDateUTC"`
+}
+
+type Allocation struct {
+	Amount  float64     `json:"Amount"`
+	Date    string      `json:"Date"`
+	Invoice XeroInvoice `json:"Invoice"`
+}
+
+type BQInvoice struct {
+	InvoiceID      string                 `bigquery:"id"`
+	Company        string                 `bigquery:"company"`
+	InvoiceNumber  string                 `bigquery:"invoice_number"`
+	Type           string                 `bigquery:"type"`
+	Status         string                 `bigquery:"status"`
+	ContactID      string                 `bigquery:"contact_id"`
+	ContactName    string                 `bigquery:"contact_name"`
+	Date           time.Time              `bigquery:"date"`
+	DueDate        bigquery.NullTimestamp `bigquery:"due_date"`
+	Reference      string                 `bigquery:"reference"`
+	CurrencyCode   string                 `bigquery:"currency_code"`
+	SubTotal       float64                `bigquery:"sub_total"`
+	TotalTax       float64                `bigquery:"total_tax"`
+	Total          float64                `bigquery:"total"`
+	AmountDue      float64                `bigquery:"amount_due"`
+	AmountPaid     float64                `bigquery:"amount_paid"`
+	AmountCredited float64                `bigquery:"amount_credited"`
+	UpdatedAt      time.Time              `bigquery:"updated_at"`
+	LineItems      []BQLineItem           `bigquery:"line_items"`
+}
+
+type BQCreditNote struct {
+	CreditNoteID     string                 `bigquery:"id"`
+	Company          string                 `bigquery:"company"`
+	CreditNoteNumber string                 `bigquery:"credit_note_number"`
+	Type             string                 `bigquery:"type"`
+	Status           string                 `bigquery:"status"`
+	ContactID        string                 `bigquery:"contact_id"`
+	ContactName      string                 `bigquery:"contact_name"`
+	Date             time.Time              `bigquery:"date"`
+	DueDate          bigquery.NullTimestamp `bigquery:"due_date"`
+	Reference        string                 `bigquery:"reference"`
+	CurrencyCode     string                 `bigquery:"currency_code"`
+	SubTotal         float64                `bigquery:"sub_total"`
+	TotalTax         float64                `bigquery:"total_tax"`
+	Total            float64                `bigquery:"total"`
+	RemainingCredit  float64                `bigquery:"remaining_credit"`
+	AppliedAmount    float64                `bigquery:"applied_amount"`
+	UpdatedAt        time.Time              `bigquery:"updated_at"`
+	LineItems        []BQLineItem           `bigquery:"line_items"`
+}
+
+type BQPayment struct {
+	PaymentID        string    `bigquery:"id"`
+	Company          string    `bigquery:"company"`
+	Date             time.Time `bigquery:"date"`
+	Amount           float64   `bigquery:"amount"`
+	BankAmount       float64   `bigquery:"bank_amount"`
+	CurrencyRate     float64   `bigquery:"currency_rate"`
+	Reference        string    `bigquery:"reference"`
+	PaymentType      string    `bigquery:"payment_type"`
+	Status           string    `bigquery:"status"`
+	IsReconciled     bool      `bigquery:"is_reconciled"`
+	AccountID        string    `bigquery:"account_id"`
+	AccountCode      string    `bigquery:"account_code"`
+	ContactID        string    `bigquery:"contact_id"`
+	ContactName      string    `bigquery:"contact_name"`
+	InvoiceID        string    `bigquery:"invoice_id"`
+	InvoiceNumber    string    `bigquery:"invoice_number"`
+	CreditNoteID     string    `bigquery:"credit_note_id"`
+	CreditNoteNumber string    `bigquery:"credit_note_number"`
+	PrepaymentID     string    `bigquery:"prepayment_id"`
+	OverpaymentID    string    `bigquery:"overpayment_id"`
+	UpdatedAt        time.Time `bigquery:"updated_at"`
+}
+
+type BQOverpayment struct {
+	OverpaymentID   string         `bigquery:"id"`
+	Company         string         `bigquery:"company"`
+	Type            string         `bigquery:"type"`
+	Status          string         `bigquery:"status"`
+	ContactID       string         `bigquery:"contact_id"`
+	ContactName     string         `bigquery:"contact_name"`
+	Date            time.Time      `bigquery:"date"`
+	CurrencyCode    string         `bigquery:"currency_code"`
+	SubTotal        float64        `bigquery:"sub_total"`
+	TotalTax        float64        `bigquery:"total_tax"`
+	Total           float64        `bigquery:"total"`
+	RemainingCredit float64        `bigquery:"remaining_credit"`
+	UpdatedAt       time.Time      `bigquery:"updated_at"`
+	LineItems       []BQLineItem   `bigquery:"line_items"`
+	Allocations     []BQAllocation `bigquery:"allocations"`
+}
+
+type BQPrepayment struct {
+	PrepaymentID    string         `bigquery:"id"`
+	Company         string         `bigquery:"company"`
+	Type            string         `bigquery:"type"`
+	Status          string         `bigquery:"status"`
+	ContactID       string         `bigquery:"contact_id"`
+	ContactName     string         `bigquery:"contact_name"`
+	Date            time.Time      `bigquery:"date"`
+	Reference       string         `bigquery:"reference"`
+	CurrencyCode    string         `bigquery:"currency_code"`
+	SubTotal        float64        `bigquery:"sub_total"`
+	TotalTax        float64        `bigquery:"total_tax"`
+	Total           float64        `bigquery:"total"`
+	RemainingCredit float64        `bigquery:"remaining_credit"`
+	UpdatedAt       time.Time      `bigquery:"updated_at"`
+	LineItems       []BQLineItem   `bigquery:"line_items"`
+	Allocations     []BQAllocation `bigquery:"allocations"`
+}
+
+type BQAllocation struct {
+	InvoiceID     string    `bigquery:"invoice_id"`
+	InvoiceNumber string    `bigquery:"invoice_number"`
 	Amount        float64   `bigquery:"amount"`
-	Reference     string    `bigquery:"reference"`
-	RevenueLine   string    `bigquery:"revenue_line"`
-	Description   string    `bigquery:"description"`
-	Group         string    `bigquery:"transfer_group"`
-	AccountCode   string    `bigquery:"account_code"`
+	Date          time.Time `bigquery:"date"`
+}
+
+type BQContact struct {
+	ContactID       string    `bigquery:"id"`
+	Company         string    `bigquery:"company"`
+	Name            string    `bigquery:"name"`
+	EmailAddress    string    `bigquery:"email_address"`
+	Groups          []string  `bigquery:"groups"`
+	IsCustomer      bool      `bigquery:"is_customer"`
+	IsSupplier      bool      `bigquery:"is_supplier"`
+	DefaultCurrency string    `bigquery:"default_currency"`
+	Status          string    `bigquery:"status"`
+	Archived        bool      `bigquery:"archived"`
+	UpdatedAt       time.Time `bigquery:"updated_at"`
+}
+
+type BQLineItem struct {
+	LineItemID  string       `bigquery:"line_item_id"`
+	AccountCode string       `bigquery:"account_code"`
+	Description string       `bigquery:"description"`
+	Quantity    float64      `bigquery:"quantity"`
+	UnitAmount  float64      `bigquery:"unit_amount"`
+	TaxType     string       `bigquery:"tax_type"`
+	TaxAmount   float64      `bigquery:"tax_amount"`
+	LineAmount  float64      `bigquery:"line_amount"`
+	Tracking    []BQTracking `bigquery:"tracking"`
+}
+
+type OrganisationsResponse struct {
+	Organisations []Organisation `json:"Organisations"`
+}
+
+type Organisation struct {
+	Name         string `json:"Name"`
+	BaseCurrency string `json:"BaseCurrency"`
+	CountryCode  string `json:"CountryCode"`
 }
 
 type AccountBody struct {
@@ -109,12 +532,29 @@ type AccountLookup struct {
 	Group string
 }
 
+type AccountRuleSet struct {
+	Version string
+	Rules   []AccountRule
+}
+
+type AccountRule struct {
+	Line          int
+	Scope         string
+	Action        string
+	SourceCode    string
+	TargetCode    string
+	EffectiveFrom time.Time
+	EffectiveTo   time.Time
+}
+
 type Journal struct {
 	JournalID      string        `json:"JournalID"`
 	JournalDate    string        `json:"JournalDate"`
 	JournalNumber  int           `json:"JournalNumber"`
 	CreatedDateUTC string        `json:"CreatedDateUTC"`
 	Reference      string        `json:"Reference"`
+	SourceID       string        `json:"SourceID"`
+	SourceType     string        `json:"SourceType"`
 	JournalLines   []JournalLine `json:"JournalLines"`
 }
 
@@ -140,10 +580,48 @@ type TrackingItem struct {
 	Option             string `json:"Option"`
 }
 
+type TrackingCategoriesResponse struct {
+	TrackingCategories []TrackingCategory `json:"TrackingCategories"`
+}
+
+type TrackingCategory struct {
+	TrackingCategoryID string           `json:"TrackingCategoryID"`
+	Name               string           `json:"Name"`
+	Status             string           `json:"Status"`
+	Options            []TrackingOption `json:"Options"`
+}
+
+type TrackingOption struct {
+	TrackingOptionID string `json:"TrackingOptionID"`
+	Name             string `json:"Name"`
+	Status           string `json:"Status"`
+}
+
+type BQTrackingCategory struct {
+	TrackingCategoryID string             `bigquery:"id"`
+	Company            string             `bigquery:"company"`
+	Name               string             `bigquery:"name"`
+	Status             string             `bigquery:"status"`
+	Options            []BQTrackingOption `bigquery:"options"`
+}
+
+type BQTrackingOption struct {
+	TrackingOptionID string `bigquery:"id"`
+	Name             string `bigquery:"name"`
+	Status           string `bigquery:"status"`
+}
+
 type JournalsResponse struct {
 	Journals []Journal `json:"Journals"`
 }
 
+type SyncState struct {
+	TenantID          string               `json:"tenant_id"`
+	ModifiedSince     map[string]time.Time `json:"modified_since"`
+	LastJournalNumber int                  `json:"last_journal_number"`
+	LastRun           time.Time            `json:"last_run"`
+}
+
 type AccountTransaction struct {
 	TransactionID string
 	Date          time.Time
@@ -151,4 +629,16 @@ type AccountTransaction struct {
 	Reference     string
 	AccountCode   string
 	Description   string
+	CurrencyCode  string
+	CurrencyRate  float64
+	GrossAmount   float64
+	NetAmount     float64
+	TaxAmount     float64
+	TaxType       string
+	ContactID     string
+	SourceID      string
+	SourceType    string
+	Origin        string
+	Tracking      []TrackingItem
+	Deleted       bool
 }